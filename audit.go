@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Values of RuleEntry.Mode
+const (
+	ruleModeEnforce = "enforce"
+	ruleModeReport  = "report"
+)
+
+// Names of the shadow policies, which prefix the reasons they log
+const (
+	shadowReportOnly = "report_only"
+	shadowCandidate  = "candidate"
+)
+
+// CandidateConfig is the candidate section of allowlist.yaml: the lists a
+// tightened configuration would enforce, in the same format as the real ones
+type CandidateConfig struct {
+	Allowlist []RuleEntry `yaml:"allowlist"`
+	Denylist  []RuleEntry `yaml:"denylist"`
+}
+
+// shadowPolicy is a pair of rule sets evaluated alongside the enforced ones.
+// A connection the enforced rules allow but a shadow policy would refuse is
+// logged as would_block and otherwise left alone.
+//
+// The report_only policy is the configuration with every report-only entry
+// in force: report-only allowlist entries removed and report-only denylist
+// entries added. The candidate policy is the candidate section.
+type shadowPolicy struct {
+	Name      string
+	allowlist *ruleSet
+	denylist  *ruleSet
+}
+
+// loadShadowPolicies builds the shadow policies described by the embedded
+// configuration, if any
+func loadShadowPolicies(config *Config) ([]shadowPolicy, error) {
+
+	var policies []shadowPolicy
+	if hasReportOnly(config.Allowlist) || hasReportOnly(config.Denylist) {
+		policy, err := compileShadowPolicy(shadowReportOnly, enforcedEntries(config.Allowlist), config.Denylist)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	if config.Candidate != nil {
+		for _, entry := range append(config.Candidate.Allowlist, config.Candidate.Denylist...) {
+			if entry.Mode != "" {
+				return nil, fmt.Errorf("invalid candidate in allowlist.yaml: entry %q cannot set a mode, candidate entries are always report-only", entry)
+			}
+		}
+		policy, err := compileShadowPolicy(shadowCandidate, config.Candidate.Allowlist, config.Candidate.Denylist)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func compileShadowPolicy(name string, allow, deny []RuleEntry) (shadowPolicy, error) {
+	allowlist, err := compileRules(allow)
+	if err != nil {
+		return shadowPolicy{}, fmt.Errorf("invalid %s allowlist in allowlist.yaml: %w", name, err)
+	}
+	denylist, err := compileRules(deny)
+	if err != nil {
+		return shadowPolicy{}, fmt.Errorf("invalid %s denylist in allowlist.yaml: %w", name, err)
+	}
+	return shadowPolicy{Name: name, allowlist: allowlist, denylist: denylist}, nil
+}
+
+// hasReportOnly reports whether any entry sets mode report
+func hasReportOnly(entries []RuleEntry) bool {
+	return len(enforcedEntries(entries)) != len(entries)
+}
+
+// enforcedEntries returns the entries that are not report-only
+func enforcedEntries(entries []RuleEntry) []RuleEntry {
+	enforced := make([]RuleEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Mode != ruleModeReport {
+			enforced = append(enforced, entry)
+		}
+	}
+	return enforced
+}
+
+// evaluate returns why the policy would refuse hostPort, "denied" or
+// "no_match", with the deny rule responsible, or "" if it would allow it
+func (s *shadowPolicy) evaluate(hostPort string) (string, *hostRule) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "no_match", nil
+	}
+	if rule, denied := s.denylist.match(host, port); denied {
+		return "denied", rule
+	}
+	if _, allowed := s.allowlist.match(host, port); allowed {
+		return "", nil
+	}
+	return "no_match", nil
+}
+
+// checkShadows logs a would_block built on entry, the connection_attempt
+// that allowed the connection, for every shadow policy that would refuse it.
+// Rule names the deny rule that would refuse it or, when nothing in the
+// policy matches, allowRule, the entry that lets it through today.
+func (p *ProxyServer) checkShadows(entry LogEntry, allowRule *hostRule) {
+	for i := range p.shadows {
+		policy := &p.shadows[i]
+		reason, denyRule := policy.evaluate(entry.Destination)
+		if reason == "" {
+			continue
+		}
+
+		shadow := entry
+		shadow.Level = LogLevelWarning
+		shadow.Event = "would_block"
+		shadow.Reason = policy.Name + "_" + reason
+		shadow.Rule = ""
+		shadow.RuleIndex = nil
+		switch {
+		case denyRule != nil:
+			shadow.Rule = denyRule.Entry
+			shadow.RuleIndex = &denyRule.Index
+		case allowRule != nil:
+			shadow.Rule = allowRule.Entry
+			shadow.RuleIndex = &allowRule.Index
+		}
+		p.logger.Log(shadow)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const auditConfig = `allowlist:
+  - .example.com
+  - host: legacy.example.net
+    mode: report
+denylist:
+  - host: tracking.example.com
+    mode: report
+candidate:
+  allowlist:
+    - api.example.com
+    - tracking.example.com
+  denylist:
+    - old.example.com
+`
+
+func TestCheckShadows(t *testing.T) {
+	proxy := newTestProxy(t, auditConfig)
+
+	tests := []struct {
+		dest    string
+		allowed bool
+		reasons []string // would_block reasons, sorted
+	}{
+		{"api.example.com:443", true, nil},
+		{"www.example.com:443", true, []string{"candidate_no_match"}},
+		{"old.example.com:443", true, []string{"candidate_denied"}},
+		{"legacy.example.net:443", true, []string{"candidate_no_match", "report_only_no_match"}},
+		{"tracking.example.com:443", true, []string{"report_only_denied"}},
+		{"blocked.example.org:443", false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dest, func(t *testing.T) {
+			var buf bytes.Buffer
+			proxy.logger = NewLogger(&buf)
+
+			if allowed := proxy.authorize(&LogEntry{Destination: tt.dest}).Allowed; allowed != tt.allowed {
+				t.Errorf("Expected allowed %v, got %v", tt.allowed, allowed)
+			}
+
+			var reasons []string
+			for _, entry := range logEntries(t, &buf) {
+				if entry.Event != "would_block" {
+					continue
+				}
+				reasons = append(reasons, entry.Reason)
+				if entry.Level != LogLevelWarning || entry.Action != "allowed" || entry.Destination != tt.dest {
+					t.Errorf("Unexpected would_block entry: %+v", entry)
+				}
+			}
+			sort.Strings(reasons)
+			if !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("Expected would_block reasons %v, got %v", tt.reasons, reasons)
+			}
+		})
+	}
+}
+
+func TestCheckShadowsRule(t *testing.T) {
+	proxy := newTestProxy(t, auditConfig)
+	var buf bytes.Buffer
+	proxy.logger = NewLogger(&buf)
+
+	proxy.authorize(&LogEntry{Destination: "old.example.com:443"})
+	proxy.authorize(&LogEntry{Destination: "legacy.example.net:443"})
+
+	rules := make(map[string]string)
+	for _, entry := range logEntries(t, &buf) {
+		if entry.Event == "would_block" {
+			rules[entry.Destination+" "+entry.Reason] = entry.Rule
+		}
+	}
+	want := map[string]string{
+		// The deny rule that would refuse the connection
+		"old.example.com:443 candidate_denied": "old.example.com",
+		// The entry that lets the connection through today
+		"legacy.example.net:443 candidate_no_match":   "legacy.example.net mode report",
+		"legacy.example.net:443 report_only_no_match": "legacy.example.net mode report",
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("Expected rules %v, got %v", want, rules)
+	}
+}
+
+func TestReportOnlyDenyNotEnforced(t *testing.T) {
+	proxy := newTestProxy(t, `allowlist:
+  - 10.0.0.0/8
+denylist:
+  - host: 10.0.0.5
+    mode: report
+`)
+	if proxy.denylist.Len() != 0 {
+		t.Errorf("Expected report-only deny entries to stay out of the enforced denylist, got %d", proxy.denylist.Len())
+	}
+	if _, err := proxy.resolveDestination(context.Background(), proxy.defaultPolicy, "10.0.0.5", "443"); err != nil {
+		t.Errorf("Report-only deny entry should not block resolved addresses: %v", err)
+	}
+}
+
+func TestLoadShadowPolicies(t *testing.T) {
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+
+	allowlistYAML = []byte("allowlist:\n  - example.com\n")
+	if policies, err := loadShadowPolicies(testConfig(t)); err != nil || len(policies) != 0 {
+		t.Errorf("Expected no shadow policies, got %v (%v)", policies, err)
+	}
+
+	allowlistYAML = []byte(auditConfig)
+	policies, err := loadShadowPolicies(testConfig(t))
+	if err != nil {
+		t.Fatalf("loadShadowPolicies failed: %v", err)
+	}
+	if len(policies) != 2 || policies[0].Name != shadowReportOnly || policies[1].Name != shadowCandidate {
+		t.Errorf("Expected report_only and candidate policies, got %+v", policies)
+	}
+
+	invalid := map[string]string{
+		"unknown mode":        "allowlist:\n  - host: example.com\n    mode: audit\n",
+		"mode in candidate":   "allowlist: []\ncandidate:\n  allowlist:\n    - host: example.com\n      mode: report\n",
+		"malformed candidate": "allowlist: []\ncandidate:\n  denylist:\n    - '*'\n",
+	}
+	for name, config := range invalid {
+		allowlistYAML = []byte(config)
+		if _, err := NewProxyServer("localhost:0", NewLogger(&bytes.Buffer{})); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if name != "unknown mode" && !strings.Contains(err.Error(), "candidate") {
+			t.Errorf("%s: expected the error to mention the candidate section, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// proxyAuthRealm is the realm sent in Proxy-Authenticate challenges
+const proxyAuthRealm = "restricted-proxy"
+
+// Reasons a proxy_auth_failed event gives
+var (
+	errMissingCredentials   = errors.New("missing_credentials")
+	errMalformedCredentials = errors.New("malformed_credentials")
+	errUnknownUser          = errors.New("unknown_user")
+	errWrongPassword        = errors.New("wrong_password")
+)
+
+// AuthConfig is the auth section of allowlist.yaml. When it lists any users,
+// every client must authenticate.
+type AuthConfig struct {
+	Users []UserConfig `yaml:"users"`
+}
+
+// UserConfig is one identity clients can authenticate as
+type UserConfig struct {
+	Name string `yaml:"name"`
+	// PasswordHash is a bcrypt hash ("$2b$...") or an argon2id hash in
+	// the PHC format ("$argon2id$v=19$m=65536,t=3,p=4$salt$hash")
+	PasswordHash string `yaml:"password_hash"`
+	// Policy names the entry of policies that applies to the user; the
+	// top-level allowlist and denylist apply when it is empty
+	Policy string `yaml:"policy"`
+}
+
+// PolicyConfig is a named policy set. Its allowlist replaces the top-level
+// allowlist for the users assigned to it; its denylist adds to the
+// top-level denylist.
+type PolicyConfig struct {
+	Allowlist []RuleEntry `yaml:"allowlist"`
+	Denylist  []RuleEntry `yaml:"denylist"`
+}
+
+// policySet is the allowlist and denylist applied to a client. The top-level
+// lists form the default set that applies without authentication.
+type policySet struct {
+	Name      string
+	allowlist *ruleSet
+	denylist  *ruleSet
+	// forwardTransport dials through this set's checks, so keep-alive
+	// connections are never shared between sets
+	forwardTransport *http.Transport
+}
+
+// proxyUser is an identity from the auth section
+type proxyUser struct {
+	Name   string
+	hash   passwordHash
+	policy *policySet // nil for the default set
+}
+
+// passwordHash checks a password against a stored hash
+type passwordHash interface {
+	matches(password []byte) bool
+}
+
+// authenticator checks client credentials against the configured users
+type authenticator struct {
+	users map[string]*proxyUser
+	// decoy is checked for unknown users so they take as long to refuse as
+	// a wrong password
+	decoy passwordHash
+	// hashing bounds how many slow hashes run at once
+	hashing chan struct{}
+
+	// verified holds a digest of the last password accepted for each user,
+	// so a client opening many tunnels pays for the slow hash only once
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// loadAuth loads the named policy sets and the users that refer to them. It
+// returns a nil authenticator when no users are configured.
+func (p *ProxyServer) loadAuth(config *Config) (*authenticator, error) {
+
+	policies := make(map[string]*policySet, len(config.Policies))
+	for name, policyConfig := range config.Policies {
+		policy, err := p.compilePolicy(name, config.Denylist, policyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %q in allowlist.yaml: %w", name, err)
+		}
+		policies[name] = policy
+	}
+
+	if config.Auth == nil || len(config.Auth.Users) == 0 {
+		if len(policies) > 0 {
+			return nil, fmt.Errorf("invalid allowlist.yaml: policies need users in the auth section")
+		}
+		return nil, nil
+	}
+
+	auth := &authenticator{
+		users:    make(map[string]*proxyUser, len(config.Auth.Users)),
+		hashing:  make(chan struct{}, runtime.NumCPU()),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	for _, userConfig := range config.Auth.Users {
+		user, err := newProxyUser(userConfig, policies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth user %q in allowlist.yaml: %w", userConfig.Name, err)
+		}
+		if _, ok := auth.users[user.Name]; ok {
+			return nil, fmt.Errorf("invalid auth user %q in allowlist.yaml: duplicate name", user.Name)
+		}
+		auth.users[user.Name] = user
+		if auth.decoy == nil {
+			auth.decoy = user.hash
+		}
+	}
+	return auth, nil
+}
+
+// compilePolicy compiles a named policy set on top of the top-level denylist
+func (p *ProxyServer) compilePolicy(name string, denylist []RuleEntry, config PolicyConfig) (*policySet, error) {
+	for _, entry := range append(append([]RuleEntry{}, config.Allowlist...), config.Denylist...) {
+		if entry.Mode != "" {
+			return nil, fmt.Errorf("entry %q cannot set a mode", entry)
+		}
+	}
+
+	allowlist, err := compileRules(config.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %w", err)
+	}
+	if err := checkDenyEntries(config.Denylist); err != nil {
+		return nil, fmt.Errorf("invalid denylist: %w", err)
+	}
+	combined, err := compileRules(append(enforcedEntries(denylist), config.Denylist...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid denylist: %w", err)
+	}
+
+	policy := &policySet{Name: name, allowlist: allowlist, denylist: combined}
+	policy.forwardTransport = p.newForwardTransport(policy)
+	return policy, nil
+}
+
+// newProxyUser parses a user's password hash and resolves its policy set
+func newProxyUser(config UserConfig, policies map[string]*policySet) (*proxyUser, error) {
+	// Basic credentials are "user:password", so the name cannot hold a colon
+	if config.Name == "" || strings.ContainsAny(config.Name, ":\r\n") {
+		return nil, fmt.Errorf("name must be non-empty and cannot contain a colon")
+	}
+	hash, err := parsePasswordHash(config.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	user := &proxyUser{Name: config.Name, hash: hash}
+	if config.Policy != "" {
+		policy, ok := policies[config.Policy]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy %q", config.Policy)
+		}
+		user.policy = policy
+	}
+	return user, nil
+}
+
+// parsePasswordHash parses a bcrypt or argon2id hash
+func parsePasswordHash(hash string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return bcryptHash(hash), nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return parseArgon2idHash(hash)
+	default:
+		return nil, fmt.Errorf("password_hash must be a bcrypt or argon2id hash")
+	}
+}
+
+// bcryptHash is a hash such as "$2b$12$..."
+type bcryptHash []byte
+
+func (h bcryptHash) matches(password []byte) bool {
+	return bcrypt.CompareHashAndPassword(h, password) == nil
+}
+
+// argon2idHash is a hash in the PHC string format used by the argon2
+// reference implementation
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2idHash parses "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>",
+// with the salt and hash in unpadded base64
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid argon2id hash: expected 5 fields")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("invalid argon2id hash: unsupported version %q", parts[2])
+	}
+
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: bad parameters %q", parts[3])
+	}
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id hash: parameters must be positive")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: bad salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id hash: bad hash")
+	}
+	return &h, nil
+}
+
+func (h *argon2idHash) matches(password []byte) bool {
+	key := argon2.IDKey(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// authenticate returns the user name and password identify, or one of the
+// errors naming why they do not
+func (a *authenticator) authenticate(name, password string) (*proxyUser, error) {
+	user, ok := a.users[name]
+	if !ok {
+		a.matches(a.decoy, password)
+		return nil, errUnknownUser
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	a.mu.Lock()
+	last, seen := a.verified[name]
+	a.mu.Unlock()
+	if seen && subtle.ConstantTimeCompare(digest[:], last[:]) == 1 {
+		return user, nil
+	}
+
+	if !a.matches(user.hash, password) {
+		return nil, errWrongPassword
+	}
+	a.mu.Lock()
+	a.verified[name] = digest
+	a.mu.Unlock()
+	return user, nil
+}
+
+// matches checks password against hash once a hashing slot is free
+func (a *authenticator) matches(hash passwordHash, password string) bool {
+	a.hashing <- struct{}{}
+	defer func() { <-a.hashing }()
+	return hash.matches([]byte(password))
+}
+
+// policyFor returns the policy set that applies to an authenticated user, or
+// the default set for "" and users without one
+func (p *ProxyServer) policyFor(user string) *policySet {
+	if p.auth != nil {
+		if u, ok := p.auth.users[user]; ok && u.policy != nil {
+			return u.policy
+		}
+	}
+	return p.defaultPolicy
+}
+
+// parseBasicCredentials decodes the value of a Proxy-Authorization header
+// using the Basic scheme
+func parseBasicCredentials(header string) (name, password string, err error) {
+	if header == "" {
+		return "", "", errMissingCredentials
+	}
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", errMalformedCredentials
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", errMalformedCredentials
+	}
+	i := strings.IndexByte(string(decoded), ':')
+	if i < 0 {
+		return "", "", errMalformedCredentials
+	}
+	return string(decoded[:i]), string(decoded[i+1:]), nil
+}
+
+// authenticateHTTP checks a request's Proxy-Authorization header when
+// authentication is configured, recording the identity in entry. Otherwise
+// it answers 407 with a Basic challenge, logs proxy_auth_failed and returns
+// false.
+func (p *ProxyServer) authenticateHTTP(w http.ResponseWriter, r *http.Request, entry *LogEntry) bool {
+	if p.auth == nil {
+		return true
+	}
+
+	name, password, err := parseBasicCredentials(r.Header.Get("Proxy-Authorization"))
+	var user *proxyUser
+	if err == nil {
+		user, err = p.auth.authenticate(name, password)
+	}
+	if err != nil {
+		p.logAuthFailed(*entry, name, err)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+proxyAuthRealm+`", charset="UTF-8"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return false
+	}
+	entry.User = user.Name
+	return true
+}
+
+// logAuthFailed logs a client that did not authenticate as name. Clients
+// commonly try without credentials first, so that is not a warning.
+func (p *ProxyServer) logAuthFailed(entry LogEntry, name string, err error) {
+	entry.Level = LogLevelWarning
+	if err == errMissingCredentials {
+		entry.Level = LogLevelInfo
+	}
+	entry.Event = "proxy_auth_failed"
+	entry.Reason = err.Error()
+	if name != "" {
+		entry.Extra = map[string]interface{}{"username": name}
+	}
+	p.logger.Log(entry)
+}
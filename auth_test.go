@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testBcrypt hashes password with the cheapest bcrypt cost
+func testBcrypt(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	return string(hash)
+}
+
+// testArgon2id hashes password with small argon2id parameters
+func testArgon2id(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// newAuthProxy returns a proxy with two users: alice under the top-level
+// lists and ci under the "ci" policy set
+func newAuthProxy(t *testing.T) (*ProxyServer, *bytes.Buffer) {
+	t.Helper()
+	proxy := newTestProxy(t, fmt.Sprintf(`allowlist:
+  - example.com
+  - '*.corp.example'
+denylist:
+  - admin.corp.example
+auth:
+  users:
+    - {name: alice, password_hash: %q}
+    - {name: ci, password_hash: %q, policy: ci}
+policies:
+  ci:
+    allowlist:
+      - mirror.example.org:443
+      - '*.corp.example'
+    denylist:
+      - secrets.corp.example
+`, testBcrypt(t, "wonderland"), testArgon2id("build")))
+	var buf bytes.Buffer
+	proxy.logger = NewLogger(&buf)
+	// Allowed destinations fail to resolve, so nothing is dialed
+	proxy.resolver = staticResolver{}
+	return proxy, &buf
+}
+
+// connectAs sends a CONNECT for dest with Basic credentials, unless user is ""
+func connectAs(proxy *ProxyServer, user, password, dest string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("CONNECT", "http://"+dest, nil)
+	req.Host = dest
+	if user != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	w := httptest.NewRecorder()
+	proxy.handleConnect(w, req)
+	return w
+}
+
+func TestParsePasswordHash(t *testing.T) {
+	for _, hash := range []string{testBcrypt(t, "secret"), testArgon2id("secret")} {
+		parsed, err := parsePasswordHash(hash)
+		if err != nil {
+			t.Fatalf("parsePasswordHash(%s): %v", hash, err)
+		}
+		if !parsed.matches([]byte("secret")) {
+			t.Errorf("%s should match its password", hash)
+		}
+		if parsed.matches([]byte("Secret")) {
+			t.Errorf("%s should not match another password", hash)
+		}
+	}
+
+	for _, hash := range []string{
+		"",
+		"secret",
+		"$2b$04$tooshort",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+	} {
+		if _, err := parsePasswordHash(hash); err == nil {
+			t.Errorf("parsePasswordHash(%q) should fail", hash)
+		}
+	}
+}
+
+func TestLoadAuthInvalid(t *testing.T) {
+	hash := testBcrypt(t, "secret")
+	configs := []string{
+		"auth:\n  users:\n    - {name: alice, password_hash: plaintext}\n",
+		fmt.Sprintf("auth:\n  users:\n    - {name: 'a:b', password_hash: %q}\n", hash),
+		fmt.Sprintf("auth:\n  users:\n    - {name: alice, password_hash: %q}\n    - {name: alice, password_hash: %q}\n", hash, hash),
+		fmt.Sprintf("auth:\n  users:\n    - {name: alice, password_hash: %q, policy: missing}\n", hash),
+		"policies:\n  ci:\n    allowlist: [example.com]\n",
+		fmt.Sprintf("auth:\n  users:\n    - {name: alice, password_hash: %q, policy: ci}\npolicies:\n  ci:\n    allowlist: [{host: example.com, mode: report}]\n", hash),
+		fmt.Sprintf("auth:\n  users:\n    - {name: alice, password_hash: %q, policy: ci}\npolicies:\n  ci:\n    denylist: [{host: example.com, require: tls}]\n", hash),
+	}
+	original := allowlistYAML
+	defer func() { allowlistYAML = original }()
+	for _, config := range configs {
+		allowlistYAML = []byte(config)
+		if _, err := NewProxyServer("localhost:0", NewLogger(io.Discard)); err == nil {
+			t.Errorf("Expected an error for config:\n%s", config)
+		}
+	}
+}
+
+func TestHandleConnectRequiresAuth(t *testing.T) {
+	proxy, buf := newAuthProxy(t)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		header   string // raw Proxy-Authorization, overrides user
+		reason   string
+	}{
+		{"missing", "", "", "", errMissingCredentials.Error()},
+		{"malformed", "", "", "Basic !!!", errMalformedCredentials.Error()},
+		{"other scheme", "", "", "Bearer token", errMalformedCredentials.Error()},
+		{"unknown user", "mallory", "wonderland", "", errUnknownUser.Error()},
+		{"wrong password", "alice", "looking-glass", "", errWrongPassword.Error()},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
+		req.Host = "example.com:443"
+		if tt.header != "" {
+			req.Header.Set("Proxy-Authorization", tt.header)
+		} else if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+			req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		}
+		w := httptest.NewRecorder()
+		proxy.handleConnect(w, req)
+
+		if w.Code != http.StatusProxyAuthRequired {
+			t.Errorf("%s: expected status %d, got %d", tt.name, http.StatusProxyAuthRequired, w.Code)
+		}
+		if got := w.Header().Get("Proxy-Authenticate"); got != `Basic realm="restricted-proxy", charset="UTF-8"` {
+			t.Errorf("%s: unexpected challenge %q", tt.name, got)
+		}
+		entries := logEntries(t, buf)
+		if len(entries) != 1 || entries[0].Event != "proxy_auth_failed" || entries[0].Reason != tt.reason || entries[0].User != "" {
+			t.Errorf("%s: expected only proxy_auth_failed with reason %s, got %+v", tt.name, tt.reason, entries)
+			continue
+		}
+		if tt.user != "" && entries[0].Extra["username"] != tt.user {
+			t.Errorf("%s: expected username %s in extra, got %v", tt.name, tt.user, entries[0].Extra)
+		}
+	}
+}
+
+func TestHandleConnectPolicySets(t *testing.T) {
+	proxy, buf := newAuthProxy(t)
+
+	tests := []struct {
+		user, password, dest string
+		action               string
+	}{
+		// alice has the top-level lists
+		{"alice", "wonderland", "example.com:443", "allowed"},
+		{"alice", "wonderland", "mirror.example.org:443", "blocked"},
+		{"alice", "wonderland", "secrets.corp.example:443", "allowed"},
+		// ci has its own allowlist, and both denylists
+		{"ci", "build", "example.com:443", "blocked"},
+		{"ci", "build", "mirror.example.org:443", "allowed"},
+		{"ci", "build", "secrets.corp.example:443", "denied_by_rule"},
+		{"ci", "build", "admin.corp.example:443", "denied_by_rule"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		connectAs(proxy, tt.user, tt.password, tt.dest)
+
+		entries := logEntries(t, buf)
+		// The first attempt carries the policy decision; allowed ones are
+		// followed by the failed lookup
+		var attempt *LogEntry
+		for i := range entries {
+			if entries[i].Event == "connection_attempt" {
+				attempt = &entries[i]
+				break
+			}
+		}
+		if attempt == nil {
+			t.Errorf("%s %s: no connection_attempt logged", tt.user, tt.dest)
+			continue
+		}
+		if attempt.Action != tt.action {
+			t.Errorf("%s %s: expected action %s, got %s", tt.user, tt.dest, tt.action, attempt.Action)
+		}
+		if attempt.User != tt.user {
+			t.Errorf("%s %s: expected user in the log, got %q", tt.user, tt.dest, attempt.User)
+		}
+		wantPolicy := ""
+		if tt.user == "ci" {
+			wantPolicy = "ci"
+		}
+		if attempt.Policy != wantPolicy {
+			t.Errorf("%s %s: expected policy %q, got %q", tt.user, tt.dest, wantPolicy, attempt.Policy)
+		}
+	}
+}
+
+func TestAuthenticatorCachesVerifiedPassword(t *testing.T) {
+	proxy, _ := newAuthProxy(t)
+	if _, err := proxy.auth.authenticate("alice", "wonderland"); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+
+	// A cached password is still checked exactly
+	proxy.auth.users["alice"].hash = bcryptHash("not a hash")
+	if _, err := proxy.auth.authenticate("alice", "wonderland"); err != nil {
+		t.Errorf("Expected the verified password to be cached, got %v", err)
+	}
+	if _, err := proxy.auth.authenticate("alice", "wonderland!"); err != errWrongPassword {
+		t.Errorf("Expected a different password to be checked against the hash, got %v", err)
+	}
+}
+
+func TestSOCKSAuth(t *testing.T) {
+	proxy, _ := newAuthProxy(t)
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	socksAddr := startSOCKS(t, proxy)
+
+	handshake := func(user, password string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", socksAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial SOCKS listener: %v", err)
+		}
+		conn.Write([]byte{socksVersion5, 2, socksMethodNoAuth, socksMethodUserPass})
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksMethodUserPass {
+			t.Fatalf("Expected username/password to be selected, got %v %v", method, err)
+		}
+		request := []byte{socksUserPassVersion, byte(len(user))}
+		request = append(request, user...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		conn.Write(request)
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			t.Fatalf("Failed to read auth status: %v", err)
+		}
+		return conn, status[1]
+	}
+
+	conn, status := handshake("alice", "nope")
+	conn.Close()
+	if status != socksUserPassFailure {
+		t.Errorf("Expected a failure status for a wrong password, got %d", status)
+	}
+	failed := waitForEvent(t, &logs, "proxy_auth_failed")
+	if failed.Reason != errWrongPassword.Error() || failed.Protocol != "socks5" {
+		t.Errorf("Unexpected proxy_auth_failed entry %+v", failed)
+	}
+
+	conn, status = handshake("ci", "build")
+	defer conn.Close()
+	if status != socksUserPassSuccess {
+		t.Fatalf("Expected success for valid credentials, got %d", status)
+	}
+	conn.Write([]byte{socksVersion5, socksCmdConnect, 0x00, socksAtypDomain, 11})
+	conn.Write([]byte("example.com"))
+	conn.Write([]byte{0x01, 0xbb})
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply[1] != socksReplyNotAllowed {
+		t.Errorf("Expected example.com to be refused under the ci policy, got reply %d", reply[1])
+	}
+}
+
+// countingHash records how often it is checked
+type countingHash struct{ checks int32 }
+
+func (h *countingHash) matches(password []byte) bool {
+	atomic.AddInt32(&h.checks, 1)
+	return false
+}
+
+func TestAuthenticatorUnknownUserChecksDecoy(t *testing.T) {
+	proxy, _ := newAuthProxy(t)
+	if proxy.auth.decoy == nil {
+		t.Fatal("Expected a decoy hash")
+	}
+	decoy := &countingHash{}
+	proxy.auth.decoy = decoy
+
+	if _, err := proxy.auth.authenticate("mallory", "wonderland"); err != errUnknownUser {
+		t.Fatalf("Expected errUnknownUser, got %v", err)
+	}
+	if decoy.checks != 1 {
+		t.Errorf("Expected an unknown user to cost one hash check, got %d", decoy.checks)
+	}
+}
+
+func TestAuthenticatorBoundsHashing(t *testing.T) {
+	proxy, _ := newAuthProxy(t)
+	// Fill every slot so the next check has to wait
+	for i := 0; i < cap(proxy.auth.hashing); i++ {
+		proxy.auth.hashing <- struct{}{}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		proxy.auth.authenticate("alice", "wrong")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the hash check to wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-proxy.auth.hashing
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Hash check did not run once a slot was free")
+	}
+}
+
+func TestClientRateLimitBeforeAuth(t *testing.T) {
+	proxy, buf := newAuthProxy(t)
+	limiter, _ := newTestLimiter(t, 0.001, 2)
+	proxy.clientLimiter = limiter
+
+	// Failed attempts use up the client's tokens, so guessing is limited
+	for i, want := range []int{http.StatusProxyAuthRequired, http.StatusProxyAuthRequired, http.StatusTooManyRequests} {
+		if w := connectAs(proxy, "alice", "guess", "example.com:443"); w.Code != want {
+			t.Fatalf("Request %d: expected status %d, got %d", i+1, want, w.Code)
+		}
+	}
+
+	var failed, limited int
+	for _, entry := range logEntries(t, buf) {
+		switch {
+		case entry.Event == "proxy_auth_failed":
+			failed++
+		case entry.Event == "connection_attempt" && entry.Action == "rate_limited":
+			limited++
+			if entry.Reason != reasonClientRateLimit || entry.User != "" {
+				t.Errorf("Unexpected rate_limited attempt %+v", entry)
+			}
+		}
+	}
+	if failed != 2 || limited != 1 {
+		t.Errorf("Expected 2 failed logins and 1 rate-limited attempt, got %d and %d", failed, limited)
+	}
+}
+
+func TestSOCKSClientRateLimitBeforeAuth(t *testing.T) {
+	proxy, _ := newAuthProxy(t)
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	limiter, _ := newTestLimiter(t, 0.001, 1)
+	proxy.clientLimiter = limiter
+	limiter.allow("127.0.0.1")
+	socksAddr := startSOCKS(t, proxy)
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial SOCKS listener: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{socksVersion5, 1, socksMethodUserPass})
+	conn.Write([]byte{socksUserPassVersion, 5, 'a', 'l', 'i', 'c', 'e', 5, 'g', 'u', 'e', 's', 's'})
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read replies: %v", err)
+	}
+	if reply[1] != socksMethodUserPass || reply[3] != socksUserPassFailure {
+		t.Errorf("Expected username/password to be selected and then refused, got %v", reply)
+	}
+
+	entry := waitForEvent(t, &logs, "connection_attempt")
+	if entry.Action != "rate_limited" || entry.Protocol != "socks5" {
+		t.Errorf("Expected a rate_limited attempt, got %+v", entry)
+	}
+	for _, entry := range logEntries(t, logs.snapshot()) {
+		if entry.Event == "proxy_auth_failed" {
+			t.Error("Credentials should not be checked for a rate-limited client")
+		}
+	}
+}
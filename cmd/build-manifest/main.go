@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"restricted-local-proxy/internal/manifest"
+)
+
+// allowlistFile is the part of allowlist.yaml recorded in the manifest.
+// Entries are kept as written, whether plain strings or mappings.
+type allowlistFile struct {
+	Allowlist []interface{}          `yaml:"allowlist"`
+	Denylist  []interface{}          `yaml:"denylist"`
+	Candidate interface{}            `yaml:"candidate"`
+	Policies  map[string]interface{} `yaml:"policies"`
+	// Only user names and policies are read; password hashes stay out of
+	// the manifest
+	Auth struct {
+		Users []manifest.User `yaml:"users"`
+	} `yaml:"auth"`
+}
+
+// variant is one binary built for every manifest
+type variant struct {
+	name      string
+	mode      string
+	discovery string
+}
+
+var variants = []variant{
+	{name: "restricted-proxy", mode: "restricted", discovery: "false"},
+	{name: "restricted-proxy-discovery", mode: "discovery", discovery: "true"},
+}
+
+// buildFlags are fixed so the same source, allowlist and toolchain always
+// produce the same bytes: no local paths and no VCS stamp
+var buildFlags = []string{"-trimpath", "-buildvcs=false"}
+
+// ldflagsFormat sets the compile-time options of a variant; the empty build
+// ID keeps it out of the binary
+const ldflagsFormat = "-buildid= -X main.DiscoveryMode=%s -X main.VerifySNI=%t"
+
+// buildEnv overrides the environment that could otherwise change the output
+var buildEnv = []string{"CGO_ENABLED=0", "GOFLAGS="}
+
+func main() {
+	allowlistPath := flag.String("allowlist", "allowlist.yaml", "Allowlist to compile into the binaries")
+	sourceDir := flag.String("source", ".", "Directory containing the proxy source")
+	outDir := flag.String("out", "dist", "Directory to write the binaries and manifest.json to")
+	verifySNI := flag.Bool("verify-sni", false, "Build with SNI verification compiled in")
+	flag.Parse()
+
+	built, err := buildManifest(*sourceDir, *allowlistPath, *outDir, *verifySNI)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := json.MarshalIndent(built, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error marshaling manifest: %v\n", err)
+		os.Exit(1)
+	}
+	manifestPath := filepath.Join(*outDir, "manifest.json")
+	if err := os.WriteFile(manifestPath, append(data, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Wrote %s for %s (allowlist %s)\n", manifestPath, built.GoVersion, built.AllowlistSHA256)
+	for _, binary := range built.Binaries {
+		fmt.Printf("  %s  %s\n", binary.SHA256, binary.Name)
+	}
+}
+
+// buildManifest builds every variant of the proxy in sourceDir with the
+// allowlist at allowlistPath, writes the binaries to outDir and returns the
+// manifest describing them
+func buildManifest(sourceDir, allowlistPath, outDir string, verifySNI bool) (*manifest.Manifest, error) {
+	allowlist, err := os.ReadFile(allowlistPath)
+	if err != nil {
+		return nil, err
+	}
+	var parsed allowlistFile
+	if err := yaml.Unmarshal(allowlist, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", allowlistPath, err)
+	}
+
+	goVersion, err := goEnv("GOVERSION")
+	if err != nil {
+		return nil, err
+	}
+	platform, err := goEnv("GOOS")
+	if err != nil {
+		return nil, err
+	}
+	arch, err := goEnv("GOARCH")
+	if err != nil {
+		return nil, err
+	}
+
+	// Build from a copy so the given allowlist is embedded without touching
+	// the checked-out allowlist.yaml
+	buildDir, err := os.MkdirTemp("", "build-manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(buildDir)
+	if err := copySource(sourceDir, buildDir, allowlist); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	configSHA256 := manifest.SHA256Hex(allowlist)
+	built := &manifest.Manifest{
+		GoVersion:       goVersion,
+		Platform:        platform + "/" + arch,
+		BuildFlags:      buildFlags,
+		AllowlistSHA256: configSHA256,
+		Allowlist:       parsed.Allowlist,
+		Denylist:        parsed.Denylist,
+		Candidate:       parsed.Candidate,
+		Policies:        parsed.Policies,
+		Users:           parsed.Auth.Users,
+	}
+
+	for _, v := range variants {
+		ldflags := fmt.Sprintf(ldflagsFormat, v.discovery, verifySNI)
+		args := append([]string{"build"}, buildFlags...)
+		args = append(args, "-ldflags", ldflags, "-o", filepath.Join(outDir, v.name), ".")
+
+		cmd := exec.Command("go", args...)
+		cmd.Dir = buildDir
+		cmd.Env = append(os.Environ(), buildEnv...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("building %s: %v\n%s", v.name, err, output)
+		}
+
+		hash, err := manifest.HashFile(filepath.Join(outDir, v.name))
+		if err != nil {
+			return nil, err
+		}
+		built.Binaries = append(built.Binaries, manifest.Binary{
+			Name:         v.name,
+			Mode:         v.mode,
+			SHA256:       hash,
+			ConfigSHA256: configSHA256,
+			LDFlags:      ldflags,
+		})
+	}
+	return built, nil
+}
+
+// copySource copies the proxy package (non-test Go files, go.mod and
+// go.sum) and the internal packages it imports from src to dst and writes
+// allowlist as dst/allowlist.yaml
+func copySource(src, dst string, allowlist []byte) error {
+	files, err := filepath.Glob(filepath.Join(src, "*.go"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Go files in %s", src)
+	}
+	files = append(files, filepath.Join(src, "go.mod"), filepath.Join(src, "go.sum"))
+
+	internal := filepath.Join(src, "internal")
+	err = filepath.WalkDir(internal, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == internal && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".go") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dst, "allowlist.yaml"), allowlist, 0644)
+}
+
+// goEnv returns the value of a go env variable for the toolchain on PATH
+func goEnv(name string) (string, error) {
+	output, err := exec.Command("go", "env", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("go env %s: %w", name, err)
+	}
+	return string(bytes.TrimSpace(output)), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"restricted-local-proxy/internal/manifest"
+)
+
+const testAllowlist = `allowlist:
+  - example.com
+  - host: api.example.com
+    ports: [443, 8443]
+denylist:
+  - admin.example.com
+auth:
+  users:
+    - {name: alice, password_hash: "$2b$04$secrethashsecrethashsecrethashsecrethashsecrethashse"}
+    - {name: ci, password_hash: "$2b$04$secrethashsecrethashsecrethashsecrethashsecrethashse", policy: ci}
+policies:
+  ci:
+    allowlist: [registry.example.com:443]
+`
+
+func TestCopySource(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for name, content := range map[string]string{
+		"main.go":        "package main\n",
+		"main_test.go":   "package main\n",
+		"go.mod":         "module example\n",
+		"go.sum":         "",
+		"allowlist.yaml": "allowlist: [original.example]\n",
+
+		"internal/manifest/manifest.go":      "package manifest\n",
+		"internal/manifest/manifest_test.go": "package manifest\n",
+		"cmd/tool/main.go":                   "package main\n",
+	} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := copySource(src, dst, []byte(testAllowlist)); err != nil {
+		t.Fatalf("copySource failed: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dst)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"allowlist.yaml", "go.mod", "go.sum", "internal", "main.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v to be copied, got %v", want, names)
+	}
+	entries, _ = os.ReadDir(filepath.Join(dst, "internal", "manifest"))
+	if len(entries) != 1 || entries[0].Name() != "manifest.go" {
+		t.Errorf("Expected only internal/manifest/manifest.go to be copied, got %v", entries)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "allowlist.yaml")); string(data) != testAllowlist {
+		t.Errorf("Expected the given allowlist to be written, got %q", data)
+	}
+
+	if err := copySource(t.TempDir(), dst, nil); err == nil {
+		t.Error("Expected an error for a directory without Go files")
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the proxy twice")
+	}
+
+	allowlistPath := filepath.Join(t.TempDir(), "allowlist.yaml")
+	if err := os.WriteFile(allowlistPath, []byte(testAllowlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+
+	built, err := buildManifest("../..", allowlistPath, outDir, false)
+	if err != nil {
+		t.Fatalf("buildManifest failed: %v", err)
+	}
+
+	if built.AllowlistSHA256 != manifest.SHA256Hex([]byte(testAllowlist)) {
+		t.Errorf("Unexpected allowlist digest %s", built.AllowlistSHA256)
+	}
+	if len(built.Allowlist) != 2 || built.Allowlist[0] != "example.com" || len(built.Denylist) != 1 {
+		t.Errorf("Unexpected entries: %v %v", built.Allowlist, built.Denylist)
+	}
+	if want := []manifest.User{{Name: "alice"}, {Name: "ci", Policy: "ci"}}; !reflect.DeepEqual(built.Users, want) {
+		t.Errorf("Expected users %v, got %v", want, built.Users)
+	}
+	if ci, ok := built.Policies["ci"].(map[string]interface{}); !ok || !reflect.DeepEqual(ci["allowlist"], []interface{}{"registry.example.com:443"}) {
+		t.Errorf("Unexpected policies %v", built.Policies)
+	}
+	if data, _ := json.Marshal(built); strings.Contains(string(data), "secrethash") {
+		t.Error("Password hashes must not be written to the manifest")
+	}
+	if built.GoVersion == "" || built.Platform == "" {
+		t.Errorf("Expected toolchain details, got %+v", built)
+	}
+
+	if len(built.Binaries) != 2 {
+		t.Fatalf("Expected two binaries, got %+v", built.Binaries)
+	}
+	for _, binary := range built.Binaries {
+		hash, err := manifest.HashFile(filepath.Join(outDir, binary.Name))
+		if err != nil || hash != binary.SHA256 {
+			t.Errorf("Hash of %s does not match the built: %s %v", binary.Name, hash, err)
+		}
+		if binary.ConfigSHA256 != built.AllowlistSHA256 {
+			t.Errorf("Expected %s to carry the allowlist digest, got %s", binary.Name, binary.ConfigSHA256)
+		}
+	}
+	if built.Binaries[0].SHA256 == built.Binaries[1].SHA256 {
+		t.Error("Expected the restricted and discovery builds to differ")
+	}
+
+	// The same inputs build the same bytes
+	again, err := buildManifest("../..", allowlistPath, t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Second buildManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(built, again) {
+		t.Errorf("Builds are not reproducible:\n%+v\n%+v", built.Binaries, again.Binaries)
+	}
+}
@@ -57,8 +57,10 @@ func main() {
 			continue
 		}
 
-		// Only process connection attempts
-		if entry.Event == "connection_attempt" && entry.Destination != "" {
+		// Only process connection attempts, skipping those refused by a deny
+		// rule or forbidden range regardless of the allowlist
+		if entry.Event == "connection_attempt" && entry.Destination != "" &&
+			entry.Action != "denied_by_rule" && entry.Action != "blocked_resolved_ip" {
 			destinations[entry.Destination] = true
 		}
 	}
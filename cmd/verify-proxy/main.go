@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"restricted-local-proxy/internal/manifest"
+	"restricted-local-proxy/internal/procnet"
+)
+
+// deletedSuffix is what the kernel appends to /proc/<pid>/exe when the
+// executable has been removed from disk
+const deletedSuffix = " (deleted)"
+
+// Result is the outcome of checking one process listening on the port
+type Result struct {
+	PID    int
+	Exe    string
+	SHA256 string
+	Match  *manifest.Binary
+	Reason string // why the check failed, empty if it passed
+}
+
+func main() {
+	port := flag.Int("port", 9091, "Port the proxy listens on")
+	manifestFile := flag.String("manifest", "", "Known-good manifest (JSON, as written by build-manifest)")
+	procRoot := flag.String("proc", "/proc", "Mount point of the proc filesystem")
+	flag.Parse()
+
+	if *manifestFile == "" {
+		fmt.Fprintf(os.Stderr, "Usage: verify-proxy -manifest <manifest.json> [-port <port>]\n")
+		os.Exit(1)
+	}
+
+	known, err := manifest.Load(*manifestFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	results, err := verify(*procRoot, *port, known)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL: %v\n", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, result := range results {
+		printResult(os.Stdout, *port, result)
+		if result.Reason != "" {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verify finds every process listening on port and checks its executable
+// against the manifest
+func verify(procRoot string, port int, known *manifest.Manifest) ([]Result, error) {
+	inodes, err := listeningInodes(procRoot, port)
+	if err != nil {
+		return nil, err
+	}
+	if len(inodes) == 0 {
+		return nil, fmt.Errorf("nothing is listening on port %d", port)
+	}
+
+	pids := procnet.Owners(procRoot, inodes)
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("cannot find the process listening on port %d (try running as root)", port)
+	}
+
+	results := make([]Result, 0, len(pids))
+	for _, pid := range pids {
+		results = append(results, checkProcess(procRoot, pid, known))
+	}
+	return results, nil
+}
+
+// checkProcess hashes the executable of pid and looks it up in known. A
+// process whose executable was deleted or replaced on disk always fails,
+// since the file on disk no longer tells you what is running.
+func checkProcess(procRoot string, pid int, known *manifest.Manifest) Result {
+	result := Result{PID: pid}
+	exeLink := filepath.Join(procRoot, strconv.Itoa(pid), "exe")
+
+	exe, err := os.Readlink(exeLink)
+	if err != nil {
+		result.Reason = fmt.Sprintf("cannot read executable: %v", err)
+		return result
+	}
+	result.Exe = exe
+
+	// Hashing through the link reads the image the process is running,
+	// even if the path now holds something else
+	result.SHA256, err = manifest.HashFile(exeLink)
+	if err != nil {
+		result.Reason = fmt.Sprintf("cannot hash executable: %v", err)
+		return result
+	}
+	result.Match = known.Lookup(result.SHA256)
+
+	switch {
+	case strings.HasSuffix(exe, deletedSuffix):
+		result.Reason = "executable has been deleted from disk"
+	case !sameFile(exeLink, exe):
+		result.Reason = "executable on disk has been replaced since the process started"
+	case result.Match == nil:
+		result.Reason = "hash is not in the manifest"
+	}
+	return result
+}
+
+// sameFile reports whether the running executable is still the file at path
+func sameFile(exeLink, path string) bool {
+	running, err := os.Stat(exeLink)
+	if err != nil {
+		return false
+	}
+	onDisk, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(running, onDisk)
+}
+
+// listeningInodes returns the inodes of the sockets listening on port in
+// /proc/net/tcp and /proc/net/tcp6
+func listeningInodes(procRoot string, port int) (map[uint64]bool, error) {
+	sockets, err := procnet.Sockets(procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s", filepath.Join(procRoot, "net/tcp"))
+	}
+	inodes := make(map[uint64]bool)
+	for _, socket := range sockets {
+		if socket.State == procnet.StateListen && socket.Local.Port == port {
+			inodes[socket.Inode] = true
+		}
+	}
+	return inodes, nil
+}
+
+// printResult reports one process as PASS or FAIL
+func printResult(w io.Writer, port int, result Result) {
+	status := "PASS"
+	if result.Reason != "" {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%s: pid %d listening on port %d\n", status, result.PID, port)
+	if result.Reason != "" {
+		fmt.Fprintf(w, "  reason:     %s\n", result.Reason)
+	}
+	if result.Exe != "" {
+		fmt.Fprintf(w, "  executable: %s\n", result.Exe)
+	}
+	if result.SHA256 != "" {
+		fmt.Fprintf(w, "  sha256:     %s\n", result.SHA256)
+	}
+	if result.Match != nil {
+		fmt.Fprintf(w, "  name:       %s\n", result.Match.Name)
+		fmt.Fprintf(w, "  mode:       %s\n", result.Match.Mode)
+		fmt.Fprintf(w, "  config:     %s\n", result.Match.ConfigSHA256)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"restricted-local-proxy/internal/manifest"
+)
+
+const tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// fakeProc builds a proc tree in which pid 4242 runs exe and holds socket
+// inode 5555, listening on port 9091 (0x2383)
+func fakeProc(t *testing.T, exe string) string {
+	t.Helper()
+	root := t.TempDir()
+
+	tcp := tcpHeader +
+		"   0: 0100007F:2383 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 5555 1 0000000000000000 100 0 0 10 0\n" +
+		"   1: 0100007F:2383 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 6666 1 0000000000000000 100 0 0 10 0\n"
+	mustWrite(t, filepath.Join(root, "net", "tcp"), tcp)
+	mustWrite(t, filepath.Join(root, "net", "tcp6"), tcpHeader)
+
+	fdDir := filepath.Join(root, "4242", "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink(t, "/dev/null", filepath.Join(fdDir, "0"))
+	mustSymlink(t, "socket:[5555]", filepath.Join(fdDir, "3"))
+	mustSymlink(t, exe, filepath.Join(root, "4242", "exe"))
+
+	// A process that cannot be inspected is skipped
+	if err := os.MkdirAll(filepath.Join(root, "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func mustWrite(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeBinary writes a stand-in executable and returns its path and hash
+func writeBinary(t *testing.T, name, content string) (string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	mustWrite(t, path, content)
+	hash, err := manifest.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, hash
+}
+
+func TestVerifyPass(t *testing.T) {
+	exe, hash := writeBinary(t, "restricted-proxy", "good binary")
+	known := &manifest.Manifest{Binaries: []manifest.Binary{
+		{Name: "restricted-proxy-discovery", Mode: "discovery", SHA256: "0000"},
+		{Name: "restricted-proxy", Mode: "restricted", SHA256: strings.ToUpper(hash), ConfigSHA256: "c0ffee"},
+	}}
+
+	results, err := verify(fakeProc(t, exe), 9091, known)
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected one result, got %+v", results)
+	}
+	result := results[0]
+	if result.Reason != "" || result.PID != 4242 || result.Exe != exe || result.SHA256 != hash {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if result.Match == nil || result.Match.Name != "restricted-proxy" || result.Match.Mode != "restricted" {
+		t.Errorf("Expected the restricted entry to match, got %+v", result.Match)
+	}
+
+	var out bytes.Buffer
+	printResult(&out, 9091, result)
+	for _, want := range []string{"PASS: pid 4242 listening on port 9091", "mode:       restricted", "config:     c0ffee"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	exe, _ := writeBinary(t, "restricted-proxy", "tampered binary")
+	deleted, deletedHash := writeBinary(t, "restricted-proxy"+deletedSuffix, "good binary")
+	known := &manifest.Manifest{Binaries: []manifest.Binary{{Name: "restricted-proxy", SHA256: deletedHash}}}
+
+	tests := []struct {
+		name   string
+		exe    string
+		reason string
+	}{
+		{"unknown hash", exe, "hash is not in the manifest"},
+		{"deleted executable", deleted, "executable has been deleted from disk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := verify(fakeProc(t, tt.exe), 9091, known)
+			if err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+			if len(results) != 1 || results[0].Reason != tt.reason {
+				t.Errorf("Expected reason %q, got %+v", tt.reason, results)
+			}
+		})
+	}
+
+	if _, err := verify(fakeProc(t, exe), 8080, known); err == nil || !strings.Contains(err.Error(), "nothing is listening") {
+		t.Errorf("Expected an error for a port without a listener, got %v", err)
+	}
+	if _, err := verify(t.TempDir(), 9091, known); err == nil {
+		t.Error("Expected an error when /proc/net/tcp cannot be read")
+	}
+}
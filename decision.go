@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Reasons a Decision gives for its outcome
+const (
+	reasonAllowedByRule      = "allowed_by_rule"
+	reasonDiscoveryMode      = "discovery_mode"
+	reasonNoMatch            = "no_match"
+	reasonPortMismatch       = "port_mismatch"
+	reasonDeniedByRule       = "denied_by_rule"
+	reasonDeniedIPRange      = "denied_ip_range"
+	reasonInvalidDestination = "invalid_destination"
+	reasonClientRateLimit    = "client_rate_limit"
+	reasonDestRateLimit      = "destination_rate_limit"
+)
+
+// Decision records whether a destination may be reached and why. It is
+// logged with the connection_attempt and returned to refused HTTP clients so
+// they can tell which rule applied without reading the proxy's logs.
+type Decision struct {
+	Destination string `json:"destination"`
+	Allowed     bool   `json:"allowed"`
+	Action      string `json:"action"`
+	Reason      string `json:"reason"`
+	// Rule is the entry that decided the outcome: the allow or deny entry
+	// that matched, the allowlist entry whose ports did not include the
+	// requested one, or the forbidden range a resolved address fell in
+	Rule string `json:"rule,omitempty"`
+	// RuleIndex is the zero-based position of Rule in its section of
+	// allowlist.yaml (or in the default forbidden ranges)
+	RuleIndex  *int   `json:"rule_index,omitempty"`
+	ResolvedIP string `json:"resolved_ip,omitempty"`
+	// Policy names the policy set applied, or "" for the top-level lists
+	Policy string `json:"policy,omitempty"`
+
+	// rule is the allowlist rule that allowed the destination, if any
+	rule *hostRule
+	// limited is the rate limit that refused an otherwise allowed
+	// destination, if any
+	limited *rateLimited
+}
+
+// isAllowed decides whether a host:port destination may be reached under the
+// top-level lists
+func (p *ProxyServer) isAllowed(hostPort string) Decision {
+	return p.isAllowedBy(p.defaultPolicy, hostPort)
+}
+
+// isAllowedBy decides whether a host:port destination may be reached by
+// applying the policy set's denylist, then its allowlist or discovery mode.
+// Resolved addresses are checked separately when dialing.
+func (p *ProxyServer) isAllowedBy(policy *policySet, hostPort string) Decision {
+	d := Decision{Destination: hostPort, Policy: policy.Name}
+
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		d.Action = "blocked"
+		d.Reason = reasonInvalidDestination
+		return d
+	}
+
+	// Explicit deny rules win over the allowlist and over discovery mode
+	if rule, denied := policy.denylist.match(host, port); denied {
+		d.Action = "denied_by_rule"
+		d.Reason = reasonDeniedByRule
+		d.setRule(rule)
+		return d
+	}
+
+	rule, allowed := policy.allowlist.match(host, port)
+	switch {
+	case allowed:
+		d.Allowed = true
+		d.Action = "allowed"
+		d.Reason = reasonAllowedByRule
+		d.setRule(rule)
+		d.rule = rule
+		if p.discoveryMode {
+			d.Action = "allowed_discovery"
+		}
+	case p.discoveryMode:
+		// In discovery mode, allow all connections and log them
+		d.Allowed = true
+		d.Action = "allowed_discovery"
+		d.Reason = reasonDiscoveryMode
+	default:
+		d.Action = "blocked"
+		d.Reason = reasonNoMatch
+		if rule, ok := policy.allowlist.match(host, anyPort); ok {
+			d.Reason = reasonPortMismatch
+			d.setRule(rule)
+		}
+	}
+	return d
+}
+
+// setRule records rule as the rule that decided the outcome
+func (d *Decision) setRule(rule *hostRule) {
+	index := rule.Index
+	d.Rule = rule.Entry
+	d.RuleIndex = &index
+}
+
+// attribute records the rule and policy that decided the outcome in a log
+// entry
+func (d Decision) attribute(entry *LogEntry) {
+	entry.Rule = d.Rule
+	entry.RuleIndex = d.RuleIndex
+	entry.Policy = d.Policy
+}
+
+// apply copies the decision into a log entry
+func (d Decision) apply(entry *LogEntry) {
+	entry.Action = d.Action
+	entry.Reason = d.Reason
+	d.attribute(entry)
+	if d.ResolvedIP != "" {
+		entry.ResolvedIP = d.ResolvedIP
+	}
+}
+
+// decision describes the refusal of destination because of the blocked address
+func (e *blockedIPError) decision(destination string) Decision {
+	index := e.Index
+	return Decision{
+		Destination: destination,
+		Action:      "blocked_resolved_ip",
+		Reason:      e.Reason,
+		Rule:        e.Rule,
+		RuleIndex:   &index,
+		ResolvedIP:  e.IP.String(),
+	}
+}
+
+// refuse answers an HTTP client whose destination was refused with 403 and
+// the decision, both as JSON in the body and in X-Proxy-Decision-* headers
+// that can be read from a failed CONNECT
+func refuse(w http.ResponseWriter, d Decision) {
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("X-Proxy-Decision-Action", d.Action)
+	header.Set("X-Proxy-Decision-Reason", d.Reason)
+	if d.Rule != "" {
+		header.Set("X-Proxy-Decision-Rule", d.Rule)
+	}
+	if d.RuleIndex != nil {
+		header.Set("X-Proxy-Decision-Rule-Index", strconv.Itoa(*d.RuleIndex))
+	}
+	w.WriteHeader(http.StatusForbidden)
+
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Decision
+	}{"Forbidden: Destination not allowed", d})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsAllowedDecision(t *testing.T) {
+	proxy := newTestProxy(t, `allowlist:
+  - example.com
+  - api.example.com:443
+  - 10.20.0.0/16:443
+denylist:
+  - admin.example.com
+`)
+
+	tests := []struct {
+		dest      string
+		allowed   bool
+		reason    string
+		rule      string
+		ruleIndex int // -1 when no rule applies
+	}{
+		{"example.com:80", true, reasonAllowedByRule, "example.com", 0},
+		{"api.example.com:443", true, reasonAllowedByRule, "api.example.com:443", 1},
+		{"api.example.com:80", false, reasonPortMismatch, "api.example.com:443", 1},
+		{"10.20.1.1:22", false, reasonPortMismatch, "10.20.0.0/16:443", 2},
+		{"admin.example.com:443", false, reasonDeniedByRule, "admin.example.com", 0},
+		{"other.example.net:443", false, reasonNoMatch, "", -1},
+		{"example.com", false, reasonInvalidDestination, "", -1},
+	}
+
+	for _, tt := range tests {
+		d := proxy.isAllowed(tt.dest)
+		if d.Allowed != tt.allowed || d.Reason != tt.reason || d.Rule != tt.rule {
+			t.Errorf("isAllowed(%s) = allowed %v, reason %q, rule %q; want %v, %q, %q",
+				tt.dest, d.Allowed, d.Reason, d.Rule, tt.allowed, tt.reason, tt.rule)
+		}
+		switch {
+		case tt.ruleIndex < 0 && d.RuleIndex != nil:
+			t.Errorf("isAllowed(%s): unexpected rule index %d", tt.dest, *d.RuleIndex)
+		case tt.ruleIndex >= 0 && (d.RuleIndex == nil || *d.RuleIndex != tt.ruleIndex):
+			t.Errorf("isAllowed(%s): expected rule index %d, got %v", tt.dest, tt.ruleIndex, d.RuleIndex)
+		}
+	}
+
+	proxy.discoveryMode = true
+	if d := proxy.isAllowed("other.example.net:443"); !d.Allowed || d.Action != "allowed_discovery" || d.Reason != reasonDiscoveryMode {
+		t.Errorf("discovery mode: unexpected decision %+v", d)
+	}
+	if d := proxy.isAllowed("example.com:443"); d.Action != "allowed_discovery" || d.Reason != reasonAllowedByRule || d.Rule != "example.com" {
+		t.Errorf("discovery mode: unexpected decision for allowlisted host %+v", d)
+	}
+}
+
+// refusal is the JSON body written by refuse
+type refusal struct {
+	Error      string `json:"error"`
+	Allowed    bool   `json:"allowed"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+	Rule       string `json:"rule"`
+	RuleIndex  *int   `json:"rule_index"`
+	ResolvedIP string `json:"resolved_ip"`
+}
+
+func connectRecorded(proxy *ProxyServer, dest string) (*httptest.ResponseRecorder, refusal) {
+	req := httptest.NewRequest("CONNECT", "http://"+dest, nil)
+	req.Host = dest
+	w := httptest.NewRecorder()
+	proxy.handleConnect(w, req)
+
+	var body refusal
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+func TestRefusalReportsDecision(t *testing.T) {
+	var buf bytes.Buffer
+	proxy := newTestProxy(t, "allowlist:\n  - example.com\n  - api.example.com:443\n")
+	proxy.logger = NewLogger(&buf)
+
+	w, body := connectRecorded(proxy, "api.example.com:8443")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	if got := w.Header().Get("X-Proxy-Decision-Reason"); got != reasonPortMismatch {
+		t.Errorf("Expected reason header %s, got %q", reasonPortMismatch, got)
+	}
+	if got := w.Header().Get("X-Proxy-Decision-Rule"); got != "api.example.com:443" {
+		t.Errorf("Expected rule header api.example.com:443, got %q", got)
+	}
+	if got := w.Header().Get("X-Proxy-Decision-Rule-Index"); got != "1" {
+		t.Errorf("Expected rule index header 1, got %q", got)
+	}
+	if body.Error == "" || body.Allowed || body.Action != "blocked" || body.Reason != reasonPortMismatch ||
+		body.Rule != "api.example.com:443" || body.RuleIndex == nil || *body.RuleIndex != 1 {
+		t.Errorf("Unexpected body %s", w.Body.String())
+	}
+
+	entries := logEntries(t, &buf)
+	last := entries[len(entries)-1]
+	if last.Reason != reasonPortMismatch || last.Rule != "api.example.com:443" || last.RuleIndex == nil || *last.RuleIndex != 1 {
+		t.Errorf("Expected logged decision, got reason %q, rule %q, index %v", last.Reason, last.Rule, last.RuleIndex)
+	}
+
+	w, body = connectRecorded(proxy, "unknown.example.net:443")
+	if w.Header().Get("X-Proxy-Decision-Reason") != reasonNoMatch || w.Header().Get("X-Proxy-Decision-Rule-Index") != "" {
+		t.Errorf("Unexpected headers for unmatched destination: %v", w.Header())
+	}
+	if body.Reason != reasonNoMatch || body.RuleIndex != nil {
+		t.Errorf("Unexpected body %s", w.Body.String())
+	}
+}
+
+func TestRefusalReportsForbiddenRange(t *testing.T) {
+	var buf bytes.Buffer
+	proxy := newTestProxy(t, "allowlist:\n  - rebind.example.com\nforbidden_ranges:\n  - 10.0.0.0/8\n  - 127.0.0.0/8\n")
+	proxy.logger = NewLogger(&buf)
+	proxy.resolver = staticResolver{"rebind.example.com": {"127.0.0.1"}}
+
+	w, body := connectRecorded(proxy, "rebind.example.com:443")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if body.Action != "blocked_resolved_ip" || body.Reason != reasonDeniedIPRange || body.Rule != "127.0.0.0/8" ||
+		body.RuleIndex == nil || *body.RuleIndex != 1 || body.ResolvedIP != "127.0.0.1" {
+		t.Errorf("Unexpected body %s", w.Body.String())
+	}
+
+	entries := logEntries(t, &buf)
+	last := entries[len(entries)-1]
+	if last.Reason != reasonDeniedIPRange || last.RuleIndex == nil || *last.RuleIndex != 1 {
+		t.Errorf("Expected logged forbidden range decision, got reason %q, index %v", last.Reason, last.RuleIndex)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// defaultForbiddenRanges are the networks a destination may not resolve to
+// unless allowlist.yaml sets forbidden_ranges explicitly: loopback, link-local
+// (including the cloud metadata address), private and unspecified addresses
+var defaultForbiddenRanges = []string{
+	"127.0.0.0/8",
+	"::1/128",
+	"169.254.0.0/16",
+	"fe80::/10",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+	"0.0.0.0/8",
+	"::/128",
+}
+
+// dialTimeout bounds the whole of resolving and connecting to a destination
+const dialTimeout = 10 * time.Second
+
+// resolver looks up the addresses of a host; *net.Resolver satisfies it
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// blockedIPError reports a destination that resolved to an address the
+// proxy refuses to dial
+type blockedIPError struct {
+	Host   string
+	IP     net.IPAddr
+	Rule   string // denylist entry or forbidden range that matched
+	Index  int    // position of Rule in the denylist or forbidden ranges
+	Reason string // reasonDeniedByRule or reasonDeniedIPRange
+}
+
+func (e *blockedIPError) Error() string {
+	return fmt.Sprintf("%s resolved to %s which is blocked by %s", e.Host, e.IP.String(), e.Rule)
+}
+
+// Classes of dial failure, logged as error_class
+const (
+	dialErrorDNSNotFound = "dns_not_found"
+	dialErrorDNSTimeout  = "dns_timeout"
+	dialErrorDNS         = "dns_error"
+	dialErrorRefused     = "refused"
+	dialErrorTimeout     = "timeout"
+	dialErrorUnreachable = "unreachable"
+	dialErrorReset       = "reset"
+	dialErrorOther       = "other"
+)
+
+// dialFailure describes how a failed dial is logged and answered
+type dialFailure struct {
+	Action string // connection_attempt action
+	Class  string // one of the dialError classes
+	Status int    // HTTP status for the client
+	Reply  byte   // SOCKS5 reply code for the client
+}
+
+// classifyDialError sorts a resolve or dial error into DNS failures,
+// refused connections, timeouts and everything else. Timeouts are answered
+// with 504 so they can be told apart from a destination that answered badly.
+func classifyDialError(err error) dialFailure {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		f := dialFailure{Action: "dns_failed", Class: dialErrorDNS, Status: http.StatusBadGateway, Reply: socksReplyHostUnreachable}
+		switch {
+		case dnsErr.IsNotFound:
+			f.Class = dialErrorDNSNotFound
+		case dnsErr.IsTimeout:
+			f.Class = dialErrorDNSTimeout
+			f.Status = http.StatusGatewayTimeout
+		}
+		return f
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialFailure{Action: "connection_refused", Class: dialErrorRefused, Status: http.StatusBadGateway, Reply: socksReplyConnectionRefused}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dialFailure{Action: "connection_timeout", Class: dialErrorTimeout, Status: http.StatusGatewayTimeout, Reply: socksReplyHostUnreachable}
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return dialFailure{Action: "connection_failed", Class: dialErrorUnreachable, Status: http.StatusBadGateway, Reply: socksReplyHostUnreachable}
+	case errors.Is(err, syscall.ECONNRESET):
+		return dialFailure{Action: "connection_failed", Class: dialErrorReset, Status: http.StatusBadGateway, Reply: socksReplyGeneralFailure}
+	default:
+		return dialFailure{Action: "connection_failed", Class: dialErrorOther, Status: http.StatusBadGateway, Reply: socksReplyGeneralFailure}
+	}
+}
+
+// compileRanges parses CIDR networks such as "10.0.0.0/8"
+func compileRanges(ranges []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forbidden range %q: %w", r, err)
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+// checkIP decides whether ip may be dialed on port. Denylist IP and CIDR
+// rules always apply; forbidden ranges apply unless an allowlist IP or CIDR
+// rule names the address explicitly.
+func (p *ProxyServer) checkIP(policy *policySet, host string, addr net.IPAddr, port string) error {
+	if rule, denied := policy.denylist.matchIP(addr.IP, port); denied {
+		return &blockedIPError{Host: host, IP: addr, Rule: rule.Entry, Index: rule.Index, Reason: reasonDeniedByRule}
+	}
+	if _, allowed := policy.allowlist.matchIP(addr.IP, port); allowed {
+		return nil
+	}
+	for i, network := range p.forbiddenRanges {
+		if network.Contains(addr.IP) {
+			return &blockedIPError{Host: host, IP: addr, Rule: network.String(), Index: i, Reason: reasonDeniedIPRange}
+		}
+	}
+	return nil
+}
+
+// resolveDestination resolves host once and vets every candidate address, so
+// a name with even one forbidden address is refused outright. The lists of
+// policy decide which addresses are exempt or denied.
+func (p *ProxyServer) resolveDestination(ctx context.Context, policy *policySet, host, port string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		resolved, err := p.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = resolved
+	}
+
+	for _, addr := range addrs {
+		if err := p.checkIP(policy, host, addr, port); err != nil {
+			return nil, err
+		}
+	}
+	return addrs, nil
+}
+
+// dialDestination resolves hostPort, vets the addresses and connects to the
+// first one that answers. Dialing the vetted address rather than the name
+// leaves no window for DNS to change between the check and the connection.
+// The address attempted last is returned alongside any error.
+func (p *ProxyServer) dialDestination(ctx context.Context, policy *policySet, hostPort string) (net.Conn, *net.IPAddr, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	addrs, err := p.resolveDestination(ctx, policy, host, port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dialer net.Dialer
+	var lastAddr *net.IPAddr
+	for i := range addrs {
+		lastAddr = &addrs[i]
+		conn, dialErr := dialer.DialContext(ctx, "tcp", net.JoinHostPort(lastAddr.String(), port))
+		if dialErr == nil {
+			return conn, lastAddr, nil
+		}
+		err = dialErr
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	return nil, lastAddr, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// staticResolver answers lookups from a fixed table
+type staticResolver map[string][]string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+// newTestProxy builds a ProxyServer from the given allowlist.yaml contents
+func newTestProxy(t *testing.T, config string) *ProxyServer {
+	t.Helper()
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+	allowlistYAML = []byte(config)
+
+	proxy, err := NewProxyServer("localhost:0", NewLogger(os.Stdout))
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+	return proxy
+}
+
+func TestResolveDestination(t *testing.T) {
+	proxy := newTestProxy(t, `allowlist:
+  - .example.com
+  - 10.20.0.0/16:443
+denylist:
+  - 203.0.113.66
+`)
+	proxy.resolver = staticResolver{
+		"public.example.com":   {"93.184.216.34", "2606:2800:220:1::1"},
+		"loopback.example.com": {"127.0.0.1"},
+		"mixed.example.com":    {"93.184.216.34", "10.1.2.3"},
+		"metadata.example.com": {"169.254.169.254"},
+		"internal.example.com": {"10.20.5.5"},
+		"denied.example.com":   {"203.0.113.66"},
+		"mapped.example.com":   {"::ffff:127.0.0.1"},
+		"ula.example.com":      {"fd00:ec2::254"},
+	}
+
+	tests := []struct {
+		host    string
+		port    string
+		blocked string
+	}{
+		{host: "public.example.com", port: "443"},
+		{host: "loopback.example.com", port: "443", blocked: "127.0.0.0/8"},
+		{host: "mixed.example.com", port: "443", blocked: "10.0.0.0/8"},
+		{host: "metadata.example.com", port: "80", blocked: "169.254.0.0/16"},
+		{host: "internal.example.com", port: "443"},
+		{host: "internal.example.com", port: "80", blocked: "10.0.0.0/8"},
+		{host: "denied.example.com", port: "443", blocked: "203.0.113.66"},
+		{host: "mapped.example.com", port: "443", blocked: "127.0.0.0/8"},
+		{host: "ula.example.com", port: "443", blocked: "fc00::/7"},
+		{host: "127.0.0.1", port: "443", blocked: "127.0.0.0/8"},
+		{host: "10.20.1.1", port: "443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+":"+tt.port, func(t *testing.T) {
+			_, err := proxy.resolveDestination(context.Background(), proxy.defaultPolicy, tt.host, tt.port)
+			var blocked *blockedIPError
+			if tt.blocked == "" {
+				if err != nil {
+					t.Fatalf("resolveDestination(%s) unexpected error: %v", tt.host, err)
+				}
+				return
+			}
+			if !errors.As(err, &blocked) {
+				t.Fatalf("resolveDestination(%s) error = %v, want blockedIPError", tt.host, err)
+			}
+			if blocked.Rule != tt.blocked {
+				t.Errorf("resolveDestination(%s) blocked by %s, want %s", tt.host, blocked.Rule, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestResolveDestinationLookupFailure(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - .example.com\n")
+	proxy.resolver = staticResolver{}
+
+	_, err := proxy.resolveDestination(context.Background(), proxy.defaultPolicy, "missing.example.com", "443")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Errorf("Expected DNS error, got %v", err)
+	}
+}
+
+func TestLoadForbiddenRanges(t *testing.T) {
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+
+	allowlistYAML = []byte("allowlist:\n  - example.com\n")
+	networks, err := loadForbiddenRanges(testConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to load default ranges: %v", err)
+	}
+	if len(networks) != len(defaultForbiddenRanges) {
+		t.Errorf("Expected %d default ranges, got %d", len(defaultForbiddenRanges), len(networks))
+	}
+
+	allowlistYAML = []byte("allowlist:\n  - example.com\nforbidden_ranges: []\n")
+	networks, err = loadForbiddenRanges(testConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to load empty ranges: %v", err)
+	}
+	if len(networks) != 0 {
+		t.Errorf("Expected no ranges, got %d", len(networks))
+	}
+
+	allowlistYAML = []byte("allowlist:\n  - example.com\nforbidden_ranges:\n  - 10.0.0.1\n")
+	if _, err := loadForbiddenRanges(testConfig(t)); err == nil {
+		t.Error("Expected error for a range without a prefix length")
+	}
+}
+
+// failingResolver fails every lookup with its error
+type failingResolver struct{ err error }
+
+func (r failingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, r.err
+}
+
+func TestClassifyDialError(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: err}}
+	}
+	tests := []struct {
+		name   string
+		err    error
+		action string
+		class  string
+		status int
+		reply  byte
+	}{
+		{"not found", &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}, "dns_failed", dialErrorDNSNotFound, http.StatusBadGateway, socksReplyHostUnreachable},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "x", IsTimeout: true}, "dns_failed", dialErrorDNSTimeout, http.StatusGatewayTimeout, socksReplyHostUnreachable},
+		{"dns server failure", &net.DNSError{Err: "server misbehaving", Name: "x"}, "dns_failed", dialErrorDNS, http.StatusBadGateway, socksReplyHostUnreachable},
+		{"refused", opErr(syscall.ECONNREFUSED), "connection_refused", dialErrorRefused, http.StatusBadGateway, socksReplyConnectionRefused},
+		{"deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), "connection_timeout", dialErrorTimeout, http.StatusGatewayTimeout, socksReplyHostUnreachable},
+		{"unreachable", opErr(syscall.EHOSTUNREACH), "connection_failed", dialErrorUnreachable, http.StatusBadGateway, socksReplyHostUnreachable},
+		{"reset", opErr(syscall.ECONNRESET), "connection_failed", dialErrorReset, http.StatusBadGateway, socksReplyGeneralFailure},
+		{"other", errors.New("something else"), "connection_failed", dialErrorOther, http.StatusBadGateway, socksReplyGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		f := classifyDialError(tt.err)
+		if f.Action != tt.action || f.Class != tt.class || f.Status != tt.status || f.Reply != tt.reply {
+			t.Errorf("%s: got %+v, want action %s, class %s, status %d, reply %d",
+				tt.name, f, tt.action, tt.class, tt.status, tt.reply)
+		}
+	}
+}
+
+func TestHandleConnectDialFailures(t *testing.T) {
+	// A port that was just closed refuses connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	tests := []struct {
+		name     string
+		dest     string
+		resolver resolver
+		status   int
+		action   string
+		class    string
+	}{
+		{"refused", fmt.Sprintf("127.0.0.1:%d", closedPort), staticResolver{}, http.StatusBadGateway, "connection_refused", dialErrorRefused},
+		{"unknown host", "missing.example.com:443", staticResolver{}, http.StatusBadGateway, "dns_failed", dialErrorDNSNotFound},
+		{"dns timeout", "slow.example.com:443", failingResolver{&net.DNSError{Err: "i/o timeout", Name: "slow.example.com", IsTimeout: true}}, http.StatusGatewayTimeout, "dns_failed", dialErrorDNSTimeout},
+		{"connect timeout", "slow.example.com:443", failingResolver{context.DeadlineExceeded}, http.StatusGatewayTimeout, "connection_timeout", dialErrorTimeout},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		proxy := newTestProxy(t, "allowlist:\n  - 127.0.0.1\n  - .example.com\n")
+		proxy.logger = NewLogger(&buf)
+		proxy.resolver = tt.resolver
+
+		req := httptest.NewRequest("CONNECT", "http://"+tt.dest, nil)
+		req.Host = tt.dest
+		w := httptest.NewRecorder()
+		proxy.handleConnect(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, w.Code)
+		}
+		if got := w.Header().Get("X-Proxy-Error-Class"); got != tt.class {
+			t.Errorf("%s: expected X-Proxy-Error-Class %s, got %q", tt.name, tt.class, got)
+		}
+
+		entries := logEntries(t, &buf)
+		last := entries[len(entries)-1]
+		if last.Action != tt.action || last.ErrorClass != tt.class || last.Error == "" {
+			t.Errorf("%s: expected action %s and class %s, got %s, %s (%q)",
+				tt.name, tt.action, tt.class, last.Action, last.ErrorClass, last.Error)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// newForwardTransport builds the transport used for plain-HTTP forwarding
+// under policy. Every new upstream connection goes through dialDestination,
+// so pooled keep-alive connections have been vetted exactly like CONNECT
+// tunnels.
+func (p *ProxyServer) newForwardTransport(policy *policySet) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, _, err := p.dialDestination(ctx, policy, addr)
+			return conn, err
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// handleForward forwards an absolute-form HTTP/1.1 request such as
+// "GET http://example.com/ HTTP/1.1" to an allowlisted host. Hop-by-hop
+// headers are stripped in both directions and bodies are streamed, never
+// logged.
+func (p *ProxyServer) handleForward(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Scheme != "http" {
+		http.Error(w, "Bad Request: only http:// URLs can be forwarded, use CONNECT for https", http.StatusBadRequest)
+		return
+	}
+	// A 101 response would turn the request into a raw pipe that none of
+	// the tunnel timeouts, quotas or shutdown handling would see
+	if isUpgrade(r.Header) {
+		http.Error(w, "Not Implemented: protocol upgrades cannot be forwarded, use CONNECT", http.StatusNotImplemented)
+		return
+	}
+
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	destHost := net.JoinHostPort(r.URL.Hostname(), port)
+	process := requestProcess(r)
+	base := newClientEntry("http", process)
+	base.Destination = destHost
+	base.Method = r.Method
+	if limited := p.limitClient(base); limited != nil {
+		tooManyRequests(w, limited)
+		return
+	}
+	process.identify(&base)
+	if !p.authenticateHTTP(w, r, &base) {
+		return
+	}
+
+	decision := p.authorize(&base)
+	if decision.limited != nil {
+		tooManyRequests(w, decision.limited)
+		return
+	}
+	if !decision.Allowed {
+		refuse(w, decision)
+		return
+	}
+	rule := decision.rule
+
+	// Forwarded requests are plain HTTP by definition
+	if rule != nil && rule.Require != "" && rule.Require != protocolHTTP {
+		p.logProtocolViolation(base, rule, protocolHTTP)
+		if !p.discoveryMode {
+			http.Error(w, "Forbidden: Destination requires "+rule.Require, http.StatusForbidden)
+			return
+		}
+	}
+
+	// Bodies are charged to the entry's bandwidth and quota as a tunnel's
+	// bytes would be, with a per-tunnel quota applying to each request
+	var traffic *trafficPolicy
+	if rule != nil {
+		traffic = rule.Traffic
+	}
+	var quotaExceeded int32
+	exceeded := func(quota *quotaError) {
+		atomic.StoreInt32(&quotaExceeded, 1)
+		p.logQuotaExceeded(base, rule, quota)
+	}
+	r.Body = traffic.shapeBody(r.Body, directionClientToDest, exceeded)
+
+	var destIP string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				destIP = addr.IP.String()
+			}
+		},
+	}
+
+	var status int
+	forwarder := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// The authority in the request line is what was checked, so it
+			// also decides the Host header sent upstream
+			req.Host = req.URL.Host
+			// A nil value stops ReverseProxy from adding X-Forwarded-For
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport: p.policyFor(base.User).forwardTransport,
+		ModifyResponse: func(resp *http.Response) error {
+			status = resp.StatusCode
+			resp.Body = traffic.shapeBody(resp.Body, directionDestToClient, exceeded)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			status = -1
+			if atomic.LoadInt32(&quotaExceeded) != 0 {
+				http.Error(w, "Forbidden: upload quota exceeded", http.StatusForbidden)
+				return
+			}
+			p.dialFailed(w, base, nil, err)
+		},
+	}
+	forwarder.ServeHTTP(w, r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+
+	if status < 0 {
+		return
+	}
+	entry := base
+	entry.Level = LogLevelInfo
+	entry.Event = "request_forwarded"
+	entry.ResolvedIP = destIP
+	entry.Extra = map[string]interface{}{"status": status}
+	p.logger.Log(entry)
+}
+
+// isUpgrade reports whether header asks to switch protocols
+func isUpgrade(header http.Header) bool {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
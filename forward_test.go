@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newForwardingClient returns a client that sends requests through proxyURL
+func newForwardingClient(t *testing.T, proxyURL string) *http.Client {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatalf("Failed to parse proxy URL: %v", err)
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+}
+
+func TestHandleForward(t *testing.T) {
+	var seen http.Header
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "secret")
+		w.Header().Set("X-Upstream", "kept")
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Host, body)
+	}))
+	defer destServer.Close()
+	destHost := strings.TrimPrefix(destServer.URL, "http://")
+
+	proxy := newTestProxy(t, "allowlist:\n  - "+destHost+"\n")
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	client := newForwardingClient(t, proxyServer.URL)
+
+	req, _ := http.NewRequest("POST", destServer.URL+"/upload", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "secret")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Client", "kept")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Forwarded request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if want := "POST " + destHost + " chunked body"; string(body) != want {
+		t.Errorf("Expected body %q, got %q", want, body)
+	}
+	for _, header := range []string{"X-Client-Hop", "Proxy-Authorization", "X-Forwarded-For"} {
+		if seen.Get(header) != "" {
+			t.Errorf("Header %s should not reach the destination", header)
+		}
+	}
+	if seen.Get("X-Client") != "kept" {
+		t.Error("End-to-end request header X-Client was dropped")
+	}
+	if resp.Header.Get("X-Upstream-Hop") != "" {
+		t.Error("Hop-by-hop response header X-Upstream-Hop should be stripped")
+	}
+	if resp.Header.Get("X-Upstream") != "kept" {
+		t.Error("End-to-end response header X-Upstream was dropped")
+	}
+
+	entry := waitForEvent(t, &logs, "request_forwarded")
+	if entry.Method != "POST" || entry.Destination != destHost {
+		t.Errorf("Unexpected request_forwarded entry: %+v", entry)
+	}
+	if strings.Contains(logs.snapshot().String(), "chunked body") {
+		t.Error("Request body must never be logged")
+	}
+}
+
+func TestHandleForwardKeepAlive(t *testing.T) {
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer destServer.Close()
+	destHost := strings.TrimPrefix(destServer.URL, "http://")
+
+	proxy := newTestProxy(t, "allowlist:\n  - "+destHost+"\n")
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, path := range []string{"/one", "/two"} {
+		fmt.Fprintf(conn, "GET %s%s HTTP/1.1\r\nHost: %s\r\n\r\n", destServer.URL, path, destHost)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response for %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != path {
+			t.Errorf("Expected body %q, got %q", path, body)
+		}
+	}
+}
+
+func TestHandleForwardBlocked(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com:443\n")
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		action string
+	}{
+		{name: "not allowlisted", target: "http://evil.com/", status: http.StatusForbidden, action: "blocked"},
+		{name: "allowlisted on another port", target: "http://example.com/", status: http.StatusForbidden, action: "blocked"},
+		{name: "not http", target: "ftp://example.com/", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+
+	entries := logEntries(t, logs.snapshot())
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %d", len(entries))
+	}
+	if entries[0].Destination != "evil.com:80" || entries[0].Method != "GET" || entries[0].Action != "blocked" {
+		t.Errorf("Unexpected log entry: %+v", entries[0])
+	}
+}
+
+func TestHandleForwardUpgradeRefused(t *testing.T) {
+	var hits int32
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "websocket")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer destServer.Close()
+	destHost := strings.TrimPrefix(destServer.URL, "http://")
+
+	proxy := newTestProxy(t, "allowlist:\n  - "+destHost+"\n")
+
+	for _, connection := range []string{"Upgrade", "keep-alive, upgrade"} {
+		req := httptest.NewRequest("GET", destServer.URL+"/socket", nil)
+		req.Header.Set("Connection", connection)
+		req.Header.Set("Upgrade", "websocket")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("Connection %q: expected status %d, got %d", connection, http.StatusNotImplemented, w.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("Expected no upgrade requests to reach the destination, got %d", n)
+	}
+}
+
+func TestHandleForwardForbiddenResolution(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - rebind.example.com\n")
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	proxy.resolver = staticResolver{"rebind.example.com": {"127.0.0.1"}}
+
+	req := httptest.NewRequest("GET", "http://rebind.example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	entries := logEntries(t, logs.snapshot())
+	if last := entries[len(entries)-1]; last.Action != "blocked_resolved_ip" {
+		t.Errorf("Expected action blocked_resolved_ip, got %s", last.Action)
+	}
+}
+
+func TestServeHTTPOriginFormRejected(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com\n")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.URL = &url.URL{Path: "/"}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
@@ -1,5 +1,10 @@
 module restricted-local-proxy
 
-go 1.16
+go 1.21
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	golang.org/x/crypto v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.8.0 // indirect
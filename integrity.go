@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"restricted-local-proxy/internal/manifest"
+)
+
+// buildDetails describes the running binary and the configuration compiled
+// into it, so the values an operator checks from outside can be compared
+// with what the proxy believes about itself
+type buildDetails struct {
+	BinaryPath      string
+	BinarySHA256    string
+	BinaryError     string // why the binary could not be hashed, if it could not
+	AllowlistSHA256 string
+	GoVersion       string
+	VCSRevision     string
+	VCSModified     bool
+	DiscoveryMode   bool
+	VerifySNI       bool
+}
+
+// currentBuild collects buildDetails for this process. The binary is hashed
+// from the path os.Executable reports.
+func currentBuild() buildDetails {
+	details := buildDetails{
+		AllowlistSHA256: manifest.SHA256Hex(allowlistYAML),
+		GoVersion:       runtime.Version(),
+		DiscoveryMode:   DiscoveryMode == "true",
+		VerifySNI:       VerifySNI == "true",
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				details.VCSRevision = setting.Value
+			case "vcs.modified":
+				details.VCSModified = setting.Value == "true"
+			}
+		}
+	}
+
+	path, err := os.Executable()
+	if err == nil {
+		details.BinaryPath = path
+		details.BinarySHA256, err = manifest.HashFile(path)
+	}
+	if err != nil {
+		details.BinaryError = err.Error()
+	}
+	return details
+}
+
+// logFields returns the details as extra fields for the proxy_starting event
+func (d buildDetails) logFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"binary_path":      d.BinaryPath,
+		"binary_sha256":    d.BinarySHA256,
+		"allowlist_sha256": d.AllowlistSHA256,
+		"go_version":       d.GoVersion,
+		"discovery_mode":   d.DiscoveryMode,
+		"verify_sni":       d.VerifySNI,
+	}
+	if d.BinaryError != "" {
+		fields["binary_error"] = d.BinaryError
+	}
+	if d.VCSRevision != "" {
+		fields["vcs_revision"] = d.VCSRevision
+		fields["vcs_modified"] = d.VCSModified
+	}
+	return fields
+}
+
+// writeVersion prints the details for the -version flag
+func writeVersion(w io.Writer, d buildDetails) {
+	mode := "restricted"
+	if d.DiscoveryMode {
+		mode = "discovery"
+	}
+	binary := d.BinarySHA256
+	if d.BinaryError != "" {
+		binary = "unavailable (" + d.BinaryError + ")"
+	}
+	revision := d.VCSRevision
+	switch {
+	case revision == "":
+		revision = "unknown"
+	case d.VCSModified:
+		revision += " (modified)"
+	}
+
+	fmt.Fprintf(w, "Mode:             %s\n", mode)
+	fmt.Fprintf(w, "SNI verification: %t\n", d.VerifySNI)
+	fmt.Fprintf(w, "Binary:           %s\n", d.BinaryPath)
+	fmt.Fprintf(w, "Binary SHA256:    %s\n", binary)
+	fmt.Fprintf(w, "Allowlist SHA256: %s\n", d.AllowlistSHA256)
+	fmt.Fprintf(w, "Go version:       %s\n", d.GoVersion)
+	fmt.Fprintf(w, "VCS revision:     %s\n", revision)
+}
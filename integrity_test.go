@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"restricted-local-proxy/internal/manifest"
+)
+
+func TestCurrentBuild(t *testing.T) {
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+	allowlistYAML = []byte("allowlist:\n  - example.com\n")
+
+	details := currentBuild()
+
+	sum := sha256.Sum256(allowlistYAML)
+	if details.AllowlistSHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected allowlist digest %s", details.AllowlistSHA256)
+	}
+	if details.GoVersion != runtime.Version() {
+		t.Errorf("Expected Go version %s, got %s", runtime.Version(), details.GoVersion)
+	}
+	if details.DiscoveryMode != (DiscoveryMode == "true") {
+		t.Errorf("Expected discovery mode %s, got %t", DiscoveryMode, details.DiscoveryMode)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skipf("os.Executable unavailable: %v", err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatalf("Failed to read test binary: %v", err)
+	}
+	if details.BinaryPath != exe || details.BinarySHA256 != manifest.SHA256Hex(data) || details.BinaryError != "" {
+		t.Errorf("Unexpected binary details: %+v", details)
+	}
+}
+
+func TestHashFileMissing(t *testing.T) {
+	if _, err := manifest.HashFile("/nonexistent/restricted-proxy"); err == nil {
+		t.Error("Expected an error hashing a missing file")
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	var out bytes.Buffer
+	writeVersion(&out, buildDetails{
+		BinaryError:     "open /proc/self/exe: permission denied",
+		AllowlistSHA256: "abc123",
+		GoVersion:       "go1.21.0",
+		VCSRevision:     "0123abcd",
+		VCSModified:     true,
+		DiscoveryMode:   true,
+	})
+
+	for _, want := range []string{
+		"Mode:             discovery\n",
+		"Binary SHA256:    unavailable (open /proc/self/exe: permission denied)\n",
+		"Allowlist SHA256: abc123\n",
+		"Go version:       go1.21.0\n",
+		"VCS revision:     0123abcd (modified)\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Version output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestProxyStartingReportsBuild(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com\n")
+	proxy.listen = "127.0.0.1:0"
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+
+	done := make(chan error, 1)
+	go func() { done <- proxy.Start() }()
+	entry := waitForEvent(t, &logs, "proxy_starting")
+	proxy.Shutdown("test", time.Second)
+	<-done
+
+	build := currentBuild()
+	for key, want := range map[string]interface{}{
+		"binary_sha256":    build.BinarySHA256,
+		"allowlist_sha256": manifest.SHA256Hex(allowlistYAML),
+		"go_version":       runtime.Version(),
+		"discovery_mode":   false,
+	} {
+		if entry.Extra[key] != want {
+			t.Errorf("Expected %s %v, got %v", key, want, entry.Extra[key])
+		}
+	}
+}
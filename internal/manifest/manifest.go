@@ -0,0 +1,95 @@
+// Package manifest defines the manifest.json format written by
+// build-manifest and read by verify-proxy, and the hashes both sides use.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Manifest is the known-good list of proxy binaries. Manifests for several
+// allowlists can be merged by concatenating their binaries, so everything
+// but Binaries is optional when reading.
+type Manifest struct {
+	GoVersion       string        `json:"go_version,omitempty"`
+	Platform        string        `json:"platform,omitempty"`
+	BuildFlags      []string      `json:"build_flags,omitempty"`
+	AllowlistSHA256 string        `json:"allowlist_sha256,omitempty"`
+	Allowlist       []interface{} `json:"allowlist"`
+	Denylist        []interface{} `json:"denylist,omitempty"`
+	Candidate       interface{}   `json:"candidate,omitempty"`
+	// Policies are the named policy sets, as written
+	Policies map[string]interface{} `json:"policies,omitempty"`
+	// Users are the identities clients can authenticate as, without
+	// their password hashes
+	Users    []User   `json:"users,omitempty"`
+	Binaries []Binary `json:"binaries"`
+}
+
+// User is an identity from the auth section and the policy set it is
+// assigned, empty for the top-level lists
+type User struct {
+	Name   string `json:"name" yaml:"name"`
+	Policy string `json:"policy,omitempty" yaml:"policy"`
+}
+
+// Binary describes one known-good binary
+type Binary struct {
+	Name         string `json:"name"`
+	Mode         string `json:"mode"`
+	SHA256       string `json:"sha256"`
+	ConfigSHA256 string `json:"config_sha256"`
+	LDFlags      string `json:"ldflags,omitempty"`
+}
+
+// Load reads a manifest file, which must list at least one binary
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(m.Binaries) == 0 {
+		return nil, fmt.Errorf("%s lists no binaries", path)
+	}
+	return &m, nil
+}
+
+// Lookup returns the binary with the given hash, if any
+func (m *Manifest) Lookup(hash string) *Binary {
+	for i := range m.Binaries {
+		if strings.EqualFold(m.Binaries[i].SHA256, hash) {
+			return &m.Binaries[i]
+		}
+	}
+	return nil
+}
+
+// SHA256Hex returns the hex-encoded SHA256 of data
+func SHA256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashFile returns the hex-encoded SHA256 of the file at path
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
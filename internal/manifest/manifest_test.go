@@ -0,0 +1,51 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "manifest.json")
+	mustWrite(t, valid, `{"go_version":"go1.21.0","binaries":[{"name":"restricted-proxy","mode":"restricted","sha256":"abc","config_sha256":"def"}]}`)
+	m, err := Load(valid)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if m.Lookup("ABC") == nil || m.Lookup("abd") != nil {
+		t.Errorf("Unexpected lookups in %+v", m)
+	}
+
+	empty := filepath.Join(dir, "empty.json")
+	mustWrite(t, empty, `{"binaries":[]}`)
+	if _, err := Load(empty); err == nil {
+		t.Error("Expected an error for a manifest without binaries")
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected an error for a missing manifest")
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "binary")
+	mustWrite(t, path, "good binary")
+	hash, err := HashFile(path)
+	if err != nil {
+		t.Fatalf("HashFile failed: %v", err)
+	}
+	if hash != SHA256Hex([]byte("good binary")) {
+		t.Errorf("HashFile and SHA256Hex disagree: %s", hash)
+	}
+	if _, err := HashFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func mustWrite(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
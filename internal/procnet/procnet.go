@@ -0,0 +1,187 @@
+// Package procnet reads TCP sockets and the processes holding them from the
+// Linux proc filesystem. It is shared by the proxy, which looks up the
+// process behind each client connection, and by verify-proxy, which finds
+// the processes listening on the proxy's port.
+package procnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StateListen is the state of a listening socket in /proc/net/tcp
+const StateListen = "0A"
+
+// Socket is one row of /proc/net/tcp or /proc/net/tcp6
+type Socket struct {
+	Local  *net.TCPAddr
+	Remote *net.TCPAddr
+	State  string // as printed by the kernel, e.g. StateListen
+	UID    int
+	Inode  uint64
+}
+
+// Sockets reads the TCP sockets in net/tcp and net/tcp6 under root, the
+// mount point of the proc filesystem. It fails only when neither table can
+// be read; rows it cannot parse are skipped.
+func Sockets(root string) ([]Socket, error) {
+	var sockets []Socket
+	var lastErr error
+	read := 0
+	for _, table := range []string{"net/tcp", "net/tcp6"} {
+		rows, err := readTable(filepath.Join(root, table))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		read++
+		sockets = append(sockets, rows...)
+	}
+	if read == 0 {
+		return nil, lastErr
+	}
+	return sockets, nil
+}
+
+// readTable parses one /proc/net/tcp style table. Its columns are:
+// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+func readTable(path string) ([]Socket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sockets []Socket
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseTCPAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remote, err := parseTCPAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		sockets = append(sockets, Socket{Local: local, Remote: remote, State: fields[3], UID: uid, Inode: inode})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseTCPAddr decodes a /proc/net/tcp address into a TCPAddr
+func parseTCPAddr(field string) (*net.TCPAddr, error) {
+	ip, port, err := ParseAddr(field)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// ParseAddr decodes a /proc/net/tcp address such as "0100007F:1F90". The
+// kernel prints the IP as 32-bit words in host byte order and the port in
+// hex.
+func ParseAddr(field string) (net.IP, int, error) {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid socket address %q", field)
+	}
+	raw, err := hex.DecodeString(field[:i])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid socket address %q", field)
+	}
+	port, err := strconv.ParseUint(field[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid socket port %q", field)
+	}
+
+	ip := make(net.IP, len(raw))
+	for w := 0; w < len(raw); w += 4 {
+		binary.NativeEndian.PutUint32(ip[w:], binary.BigEndian.Uint32(raw[w:]))
+	}
+	return ip, int(port), nil
+}
+
+// Owner returns the PID of a process holding a file descriptor for the
+// socket inode
+func Owner(root string, inode uint64) (int, bool) {
+	owner, found := 0, false
+	walkSocketFDs(root, func(pid int, fdInode uint64) bool {
+		if fdInode != inode {
+			return true
+		}
+		owner, found = pid, true
+		return false
+	})
+	return owner, found
+}
+
+// Owners returns the sorted PIDs of the processes holding a file descriptor
+// for any of the socket inodes
+func Owners(root string, inodes map[uint64]bool) []int {
+	seen := make(map[int]bool)
+	var pids []int
+	walkSocketFDs(root, func(pid int, inode uint64) bool {
+		if inodes[inode] && !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+		return true
+	})
+	sort.Ints(pids)
+	return pids
+}
+
+// walkSocketFDs calls fn with the PID and inode of every socket file
+// descriptor under root until fn returns false. Processes whose descriptors
+// cannot be read are skipped.
+func walkSocketFDs(root string, fn func(pid int, inode uint64) bool) {
+	procs, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(root, proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") || !strings.HasSuffix(link, "]") {
+				continue
+			}
+			inode, err := strconv.ParseUint(link[len("socket:["):len(link)-1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if !fn(pid, inode) {
+				return
+			}
+		}
+	}
+}
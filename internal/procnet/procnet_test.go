@@ -0,0 +1,117 @@
+package procnet
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("expected addresses are written for little-endian hosts")
+	}
+
+	tests := []struct {
+		field string
+		ip    string
+		port  int
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080},
+		{"00000000:0000", "0.0.0.0", 0},
+		{"00000000000000000000000001000000:0050", "::1", 80},
+		{"0000000000000000FFFF00000100007F:1F90", "127.0.0.1", 8080},
+	}
+	for _, tt := range tests {
+		ip, port, err := ParseAddr(tt.field)
+		if err != nil {
+			t.Errorf("ParseAddr(%q) error: %v", tt.field, err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tt.ip)) || port != tt.port {
+			t.Errorf("ParseAddr(%q) = %s:%d, want %s:%d", tt.field, ip, port, tt.ip, tt.port)
+		}
+	}
+
+	for _, field := range []string{"", "0100007F", "0100007F:XYZ", "01007F:1F90", "zz00007F:1F90"} {
+		if _, _, err := ParseAddr(field); err == nil {
+			t.Errorf("ParseAddr(%q) should fail", field)
+		}
+	}
+}
+
+// fakeProc builds a proc tree with one listening and one connected socket in
+// net/tcp and no net/tcp6. Pid 4242 holds the listening socket, pid 4343
+// the connected one, and pid 1 cannot be inspected.
+func fakeProc(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	tcp := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		"   0: 0100007F:2383 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 5555 1 0000000000000000 100 0 0 10 0\n" +
+		"   1: 0100007F:2383 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1001        0 6666 1 0000000000000000 100 0 0 10 0\n" +
+		"   2: garbage\n"
+	if err := os.MkdirAll(filepath.Join(root, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "net", "tcp"), []byte(tcp), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for pid, inode := range map[string]string{"4242": "5555", "4343": "6666"} {
+		fdDir := filepath.Join(root, pid, "fd")
+		if err := os.MkdirAll(fdDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("/dev/null", filepath.Join(fdDir, "0")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("socket:["+inode+"]", filepath.Join(fdDir, "3")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestSockets(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the fake table is written for little-endian hosts")
+	}
+	root := fakeProc(t)
+
+	sockets, err := Sockets(root)
+	if err != nil {
+		t.Fatalf("Sockets failed: %v", err)
+	}
+	if len(sockets) != 2 {
+		t.Fatalf("Expected 2 sockets, got %+v", sockets)
+	}
+	listen, conn := sockets[0], sockets[1]
+	if listen.State != StateListen || listen.Local.String() != "127.0.0.1:9091" || listen.UID != 1000 || listen.Inode != 5555 {
+		t.Errorf("Unexpected listening socket %+v", listen)
+	}
+	if conn.State == StateListen || conn.Remote.String() != "127.0.0.1:54321" || conn.UID != 1001 || conn.Inode != 6666 {
+		t.Errorf("Unexpected connected socket %+v", conn)
+	}
+
+	if _, err := Sockets(t.TempDir()); err == nil {
+		t.Error("Expected an error when no table can be read")
+	}
+}
+
+func TestOwners(t *testing.T) {
+	root := fakeProc(t)
+
+	if pid, ok := Owner(root, 6666); !ok || pid != 4343 {
+		t.Errorf("Owner(6666) = %d, %v, want 4343", pid, ok)
+	}
+	if _, ok := Owner(root, 7777); ok {
+		t.Error("Expected no owner for an unknown inode")
+	}
+	pids := Owners(root, map[uint64]bool{5555: true, 6666: true, 7777: true})
+	if len(pids) != 2 || pids[0] != 4242 || pids[1] != 4343 {
+		t.Errorf("Owners() = %v, want [4242 4343]", pids)
+	}
+}
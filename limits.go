@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverLimits bound what a client can make the proxy hold open before it
+// has sent a request
+type serverLimits struct {
+	// ReadHeaderTimeout is how long a client has to send a complete request
+	// line and headers once connected
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection may wait for its next
+	// request
+	IdleTimeout time.Duration
+	// MaxHeaderBytes caps the size of a request line and headers
+	MaxHeaderBytes int
+	// MaxConnections caps the HTTP and SOCKS5 connections open at once,
+	// tunnels included
+	MaxConnections int
+}
+
+// defaultServerLimits are compiled in. A CONNECT request is a single line
+// and a few headers, so a much smaller header limit than net/http's 1MB
+// default is plenty.
+var defaultServerLimits = serverLimits{
+	ReadHeaderTimeout: 10 * time.Second,
+	IdleTimeout:       60 * time.Second,
+	MaxHeaderBytes:    16 << 10,
+	MaxConnections:    1024,
+}
+
+// capacityRejectTimeout bounds writing the 503 to a rejected client
+const capacityRejectTimeout = 5 * time.Second
+
+// maxRejecting caps the rejected clients a listener answers at once. Past
+// it, further rejected connections are closed without an answer.
+const maxRejecting = 64
+
+// capacityLogInterval is the least time between two
+// connection_rejected_capacity entries for one listener
+const capacityLogInterval = time.Second
+
+// capacityResponse is sent to HTTP clients that connect while the proxy is
+// at its connection limit
+const capacityResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: 42\r\n" +
+	"\r\n" +
+	"Service Unavailable: too many connections\n"
+
+// newHTTPServer returns the server for the HTTP proxy listener
+func (p *ProxyServer) newHTTPServer() *http.Server {
+	return &http.Server{
+		Handler:           p,
+		ConnContext:       withClientProcess,
+		ReadHeaderTimeout: p.limits.ReadHeaderTimeout,
+		IdleTimeout:       p.limits.IdleTimeout,
+		MaxHeaderBytes:    p.limits.MaxHeaderBytes,
+	}
+}
+
+// limitListener hands out accepted connections while a slot is free and
+// turns the rest away with reject, running at most maxRejecting of those at
+// once. A slot is held until the connection is closed, which for hijacked
+// CONNECT requests is when the tunnel ends.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	rejecting chan struct{}
+	rejected  func(net.Conn)
+	reject    func(net.Conn)
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+		default:
+			l.rejected(conn)
+			select {
+			case l.rejecting <- struct{}{}:
+				go func() {
+					defer func() { <-l.rejecting }()
+					l.reject(conn)
+				}()
+			default:
+				conn.Close()
+			}
+		}
+	}
+}
+
+// limitedConn frees its listener slot when first closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// limitConnections wraps listener so that it shares the proxy's connection
+// slots, rejecting clients of protocol once they are all taken. A nil slots
+// channel leaves listener unlimited.
+func (p *ProxyServer) limitConnections(listener net.Listener, slots chan struct{}, protocol string) net.Listener {
+	if slots == nil {
+		return listener
+	}
+	var throttle rejectionLog
+	return &limitListener{
+		Listener:  listener,
+		slots:     slots,
+		rejecting: make(chan struct{}, maxRejecting),
+		rejected: func(conn net.Conn) {
+			suppressed, ok := throttle.record(time.Now())
+			if !ok {
+				return
+			}
+			// The client's process is not looked up: rejections happen
+			// when the proxy is already busy
+			extra := map[string]interface{}{"max_connections": cap(slots)}
+			if suppressed > 0 {
+				extra["suppressed"] = suppressed
+			}
+			p.logger.Log(LogEntry{
+				Level:      LogLevelWarning,
+				Event:      "connection_rejected_capacity",
+				ClientAddr: conn.RemoteAddr().String(),
+				Protocol:   protocol,
+				Extra:      extra,
+			})
+		},
+		reject: func(conn net.Conn) {
+			defer conn.Close()
+			if protocol != "http" {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(capacityRejectTimeout))
+			conn.Write([]byte(capacityResponse))
+			// Read what the client sent before closing, so the close is
+			// not a reset that loses the response
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+				io.Copy(io.Discard, io.LimitReader(conn, int64(p.limits.MaxHeaderBytes)))
+			}
+		},
+	}
+}
+
+// rejectionLog lets through one connection_rejected_capacity entry per
+// capacityLogInterval and counts the rejections it holds back
+type rejectionLog struct {
+	mu         sync.Mutex
+	next       time.Time
+	suppressed int
+}
+
+// record notes a rejection at now. It reports whether to log it and, if so,
+// how many rejections went unlogged since the last entry.
+func (r *rejectionLog) record(now time.Time) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Before(r.next) {
+		r.suppressed++
+		return 0, false
+	}
+	suppressed := r.suppressed
+	r.next = now.Add(capacityLogInterval)
+	r.suppressed = 0
+	return suppressed, true
+}
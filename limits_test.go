@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadHeaderTimeout(t *testing.T) {
+	proxy, _, _ := newEchoTunnelProxy(t)
+	proxy.limits.ReadHeaderTimeout = 200 * time.Millisecond
+	proxyAddr, _ := serveTestProxy(t, proxy)
+	defer proxy.Shutdown("test", 0)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// A request line that never finishes must not hold the connection open
+	started := time.Now()
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: exa"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("Expected the proxy to close the connection, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Connection closed after %s", elapsed)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	proxy, _, dest := newEchoTunnelProxy(t)
+	proxy.limits.MaxHeaderBytes = 1024
+	proxyAddr, _ := serveTestProxy(t, proxy)
+	defer proxy.Shutdown("test", 0)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// net/http allows some slack over MaxHeaderBytes, so send well over it
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Padding: %s\r\n\r\n", dest, dest, strings.Repeat("a", 16<<10))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxy.limits.MaxConnections = 2
+	proxyAddr, _ := serveTestProxy(t, proxy)
+	defer proxy.Shutdown("test", 0)
+
+	// An open tunnel and a connection that has not sent anything yet both
+	// take a slot
+	tunnel, _, status := connectThrough(t, proxyAddr, dest)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	idle, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer idle.Close()
+
+	rejected, _, status := connectThrough(t, proxyAddr, dest)
+	rejected.Close()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d at capacity, got %d", http.StatusServiceUnavailable, status)
+	}
+	entry := waitForEvent(t, logs, "connection_rejected_capacity")
+	if entry.ClientAddr == "" || entry.Extra["max_connections"] != float64(2) {
+		t.Errorf("Unexpected connection_rejected_capacity entry: %+v", entry)
+	}
+
+	// Closing the tunnel frees its slot
+	tunnel.Close()
+	waitForTunnels(t, proxy, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, status := connectThrough(t, proxyAddr, dest)
+		conn.Close()
+		if status == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a free slot after the tunnel closed, got status %d", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMaxConnectionsSharedWithSOCKS(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxy.limits.MaxConnections = 1
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go proxy.Serve(listener, socksListener)
+	defer proxy.Shutdown("test", 0)
+
+	held, _, status := connectThrough(t, listener.Addr().String(), dest)
+	defer held.Close()
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	waitForTunnels(t, proxy, 1)
+
+	socks, err := net.Dial("tcp", socksListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial SOCKS listener: %v", err)
+	}
+	defer socks.Close()
+	socks.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := socks.Read(make([]byte, 1)); err == nil || n != 0 {
+		t.Errorf("Expected the SOCKS client to be turned away, read %d bytes (%v)", n, err)
+	}
+
+	entry := waitForEvent(t, logs, "connection_rejected_capacity")
+	if entry.Protocol != "socks5" {
+		t.Errorf("Expected protocol socks5, got %q", entry.Protocol)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	proxy, _, _ := newEchoTunnelProxy(t)
+	proxy.limits.IdleTimeout = 200 * time.Millisecond
+	proxyAddr, _ := serveTestProxy(t, proxy)
+	defer proxy.Shutdown("test", 0)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// The refusal leaves the connection open for another request, but only
+	// for IdleTimeout
+	fmt.Fprintf(conn, "GET http://blocked.example/ HTTP/1.1\r\nHost: blocked.example\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || resp.Close {
+		t.Fatalf("Expected a keep-alive 403, got %d (close %v)", resp.StatusCode, resp.Close)
+	}
+
+	idleSince := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatalf("Expected the proxy to close the idle connection, got %v", err)
+	}
+	if elapsed := time.Since(idleSince); elapsed > 2*time.Second {
+		t.Errorf("Idle connection closed after %s", elapsed)
+	}
+}
+
+func TestLimitListenerBoundsRejects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	release := make(chan struct{})
+	var rejected int32
+	limited := &limitListener{
+		Listener:  listener,
+		slots:     make(chan struct{}), // always full
+		rejecting: make(chan struct{}, 1),
+		rejected:  func(net.Conn) { atomic.AddInt32(&rejected, 1) },
+		reject: func(conn net.Conn) {
+			<-release
+			conn.Close()
+		},
+	}
+	go limited.Accept()
+	defer listener.Close()
+	defer close(release)
+
+	// The first rejected client is held by reject; with no room for a
+	// second, it is closed straight away
+	held, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer held.Close()
+	dropped, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer dropped.Close()
+
+	dropped.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dropped.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the second connection to be closed, got %v", err)
+	}
+	held.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := held.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the first connection to be held open, got %v", err)
+	}
+	if n := atomic.LoadInt32(&rejected); n != 2 {
+		t.Errorf("Expected both rejections to be recorded, got %d", n)
+	}
+}
+
+func TestRejectionLog(t *testing.T) {
+	var log rejectionLog
+	start := time.Now()
+
+	if suppressed, ok := log.record(start); !ok || suppressed != 0 {
+		t.Errorf("First rejection: got %d, %v", suppressed, ok)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, ok := log.record(start.Add(time.Duration(i) * 100 * time.Millisecond)); ok {
+			t.Errorf("Rejection %d within the interval should not be logged", i)
+		}
+	}
+	if suppressed, ok := log.record(start.Add(capacityLogInterval)); !ok || suppressed != 3 {
+		t.Errorf("Expected 3 suppressed rejections once the interval passed, got %d, %v", suppressed, ok)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,7 +14,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -21,19 +28,102 @@ var allowlistYAML []byte
 
 // Config represents the YAML configuration structure
 type Config struct {
-	Allowlist []string `yaml:"allowlist"`
+	Allowlist []RuleEntry `yaml:"allowlist"`
+	Denylist  []RuleEntry `yaml:"denylist"`
+	// ForbiddenRanges replaces defaultForbiddenRanges when set; an empty
+	// list disables the check
+	ForbiddenRanges []string `yaml:"forbidden_ranges"`
+	// Timeouts replaces defaultTunnelTimeouts for the tunnels of every entry
+	// that does not set its own
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+	// RateLimits limits how fast new connections may be made
+	RateLimits RateLimitConfig `yaml:"rate_limits"`
+	// Auth requires clients to authenticate as one of its users
+	Auth *AuthConfig `yaml:"auth"`
+	// Policies are named policy sets that users can be assigned to
+	Policies map[string]PolicyConfig `yaml:"policies"`
+	// Candidate is a proposed replacement for the lists above, evaluated in
+	// shadow only
+	Candidate *CandidateConfig `yaml:"candidate"`
 }
 
 // DiscoveryMode is set at compile time using -ldflags "-X main.DiscoveryMode=true"
 var DiscoveryMode = "false"
 
-// loadAllowlist loads and parses the embedded YAML configuration
-func loadAllowlist() ([]string, error) {
+// loadConfig loads and parses the embedded YAML configuration
+func loadConfig() (*Config, error) {
 	var config Config
 	if err := yaml.Unmarshal(allowlistYAML, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse allowlist.yaml: %w", err)
 	}
-	return config.Allowlist, nil
+
+	sections := [][]RuleEntry{config.Allowlist, config.Denylist}
+	if config.Candidate != nil {
+		sections = append(sections, config.Candidate.Allowlist, config.Candidate.Denylist)
+	}
+	for _, policy := range config.Policies {
+		sections = append(sections, policy.Allowlist, policy.Denylist)
+	}
+	for _, entries := range sections {
+		for i := range entries {
+			entries[i].Index = i
+		}
+	}
+	return &config, nil
+}
+
+// loadAllowlist loads the allowlist section of the embedded configuration into rules
+func loadAllowlist(config *Config) (*ruleSet, error) {
+	allowlist, err := compileRules(config.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist in allowlist.yaml: %w", err)
+	}
+	return allowlist, nil
+}
+
+// loadDenylist loads the enforced entries of the denylist section of the
+// embedded configuration into rules. Report-only entries are validated here
+// but only evaluated by the report_only shadow policy.
+func loadDenylist(config *Config) (*ruleSet, error) {
+	if err := checkDenyEntries(config.Denylist); err != nil {
+		return nil, fmt.Errorf("invalid denylist in allowlist.yaml: %w", err)
+	}
+	return compileRules(enforcedEntries(config.Denylist))
+}
+
+// checkDenyEntries compiles denylist entries and rejects the settings that
+// only apply to tunnels an entry allows
+func checkDenyEntries(entries []RuleEntry) error {
+	denylist, err := compileRules(entries)
+	if err != nil {
+		return err
+	}
+	for _, rule := range denylist.rules {
+		if rule.Require != "" {
+			return fmt.Errorf("entry %q cannot require a protocol", rule.Entry)
+		}
+		if rule.IdleTimeout != nil || rule.MaxLifetime != nil {
+			return fmt.Errorf("entry %q cannot set timeouts", rule.Entry)
+		}
+		if rule.Traffic != nil {
+			return fmt.Errorf("entry %q cannot set bandwidth or quota", rule.Entry)
+		}
+	}
+	return nil
+}
+
+// loadForbiddenRanges loads the networks destinations may not resolve to,
+// falling back to defaultForbiddenRanges when the configuration has none
+func loadForbiddenRanges(config *Config) ([]*net.IPNet, error) {
+	ranges := config.ForbiddenRanges
+	if ranges == nil {
+		ranges = defaultForbiddenRanges
+	}
+	networks, err := compileRanges(ranges)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forbidden_ranges in allowlist.yaml: %w", err)
+	}
+	return networks, nil
 }
 
 // LogLevel represents the severity of a log message
@@ -48,15 +138,35 @@ const (
 
 // LogEntry represents a structured log entry
 type LogEntry struct {
-	Timestamp    string                 `json:"timestamp"`
-	Level        LogLevel               `json:"level"`
-	Event        string                 `json:"event"`
-	Destination  string                 `json:"destination,omitempty"`
-	Action       string                 `json:"action,omitempty"`
-	Error        string                 `json:"error,omitempty"`
-	AllowedCount int                    `json:"allowed_count,omitempty"`
-	Message      string                 `json:"message,omitempty"`
-	Extra        map[string]interface{} `json:"extra,omitempty"`
+	Timestamp        string                 `json:"timestamp"`
+	Level            LogLevel               `json:"level"`
+	Event            string                 `json:"event"`
+	ConnectionID     string                 `json:"connection_id,omitempty"`
+	ClientAddr       string                 `json:"client_addr,omitempty"`
+	ClientPID        int                    `json:"client_pid,omitempty"`
+	ClientUID        *int                   `json:"client_uid,omitempty"`
+	ClientExe        string                 `json:"client_exe,omitempty"`
+	User             string                 `json:"user,omitempty"`
+	Policy           string                 `json:"policy,omitempty"`
+	Destination      string                 `json:"destination,omitempty"`
+	Action           string                 `json:"action,omitempty"`
+	Method           string                 `json:"method,omitempty"`
+	Protocol         string                 `json:"protocol,omitempty"`
+	SNI              string                 `json:"sni,omitempty"`
+	DetectedProtocol string                 `json:"detected_protocol,omitempty"`
+	BytesSent        uint64                 `json:"bytes_sent,omitempty"`     // client to destination
+	BytesReceived    uint64                 `json:"bytes_received,omitempty"` // destination to client
+	DurationMs       int64                  `json:"duration_ms,omitempty"`
+	ClosedBy         string                 `json:"closed_by,omitempty"`
+	Reason           string                 `json:"reason,omitempty"`
+	Rule             string                 `json:"rule,omitempty"`
+	RuleIndex        *int                   `json:"rule_index,omitempty"`
+	ResolvedIP       string                 `json:"resolved_ip,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	ErrorClass       string                 `json:"error_class,omitempty"`
+	AllowedCount     int                    `json:"allowed_count,omitempty"`
+	Message          string                 `json:"message,omitempty"`
+	Extra            map[string]interface{} `json:"extra,omitempty"`
 }
 
 // Logger handles structured logging
@@ -90,67 +200,198 @@ func (l *Logger) Error(event, message, errMsg string) {
 	l.Log(LogEntry{Level: LogLevelError, Event: event, Message: message, Error: errMsg})
 }
 
-// ConnectionAttempt logs a connection attempt
-func (l *Logger) ConnectionAttempt(destination, action string, err error) {
-	entry := LogEntry{
-		Level:       LogLevelInfo,
-		Event:       "connection_attempt",
-		Destination: destination,
-		Action:      action,
-	}
-	if err != nil {
-		entry.Level = LogLevelError
-		entry.Error = err.Error()
-	}
-	l.Log(entry)
-}
-
-// ProxyServer handles HTTP CONNECT requests for tunneling
+// ProxyServer handles HTTP CONNECT requests for tunneling and forwards
+// plain-HTTP requests made in absolute form
 type ProxyServer struct {
-	allowlist     map[string]bool
-	listen        string
-	discoveryMode bool
-	logger        *Logger
+	allowlist       *ruleSet
+	denylist        *ruleSet
+	forbiddenRanges []*net.IPNet
+	shadows         []shadowPolicy
+	timeouts        tunnelTimeouts
+	limits          serverLimits
+	// clientLimiter and destinationLimiter are nil when not configured
+	clientLimiter      *rateLimiter
+	destinationLimiter *rateLimiter
+	resolver           resolver
+	listen             string
+	socksListen        string // optional SOCKS5 listener address
+	metricsListen      string // optional Prometheus metrics listener address
+	discoveryMode      bool
+	verifySNI          bool
+	logger             *Logger
+	metrics            *metrics
+
+	// defaultPolicy holds the top-level allowlist and denylist
+	defaultPolicy *policySet
+	// auth is nil unless clients must authenticate
+	auth *authenticator
+
+	// mu guards the fields below, which track what Shutdown must stop
+	mu            sync.Mutex
+	server        *http.Server
+	socksListener net.Listener
+	metricsServer *http.Server
+	tunnels       map[*trackedTunnel]struct{}
+	tunnelsWG     sync.WaitGroup
+	closing       bool
 }
 
 // NewProxyServer creates a new proxy server with the embedded YAML allowlist
 func NewProxyServer(listen string, logger *Logger) (*ProxyServer, error) {
-	allowlistEntries, err := loadAllowlist()
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist, err := loadAllowlist(config)
+	if err != nil {
+		return nil, err
+	}
+
+	denylist, err := loadDenylist(config)
 	if err != nil {
 		return nil, err
 	}
 
-	allowMap := make(map[string]bool)
-	for _, entry := range allowlistEntries {
-		allowMap[entry] = true
+	forbiddenRanges, err := loadForbiddenRanges(config)
+	if err != nil {
+		return nil, err
+	}
+
+	shadows, err := loadShadowPolicies(config)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts, err := loadTimeouts(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clientLimiter, destinationLimiter, err := loadRateLimiters(config)
+	if err != nil {
+		return nil, err
 	}
 
 	discoveryMode := DiscoveryMode == "true"
 
-	return &ProxyServer{
-		allowlist:     allowMap,
-		listen:        listen,
-		discoveryMode: discoveryMode,
-		logger:        logger,
-	}, nil
+	proxy := &ProxyServer{
+		allowlist:          allowlist,
+		denylist:           denylist,
+		forbiddenRanges:    forbiddenRanges,
+		shadows:            shadows,
+		timeouts:           timeouts,
+		limits:             defaultServerLimits,
+		clientLimiter:      clientLimiter,
+		destinationLimiter: destinationLimiter,
+		resolver:           net.DefaultResolver,
+		listen:             listen,
+		discoveryMode:      discoveryMode,
+		verifySNI:          VerifySNI == "true",
+		logger:             logger,
+		metrics:            newMetrics(),
+		tunnels:            make(map[*trackedTunnel]struct{}),
+	}
+	proxy.defaultPolicy = &policySet{allowlist: allowlist, denylist: denylist}
+	proxy.defaultPolicy.forwardTransport = proxy.newForwardTransport(proxy.defaultPolicy)
+
+	if proxy.auth, err = proxy.loadAuth(config); err != nil {
+		return nil, err
+	}
+
+	return proxy, nil
 }
 
-// isAllowed checks if a host:port combination is allowed
-func (p *ProxyServer) isAllowed(hostPort string) bool {
-	// Check exact match first (host:port)
-	if p.allowlist[hostPort] {
-		return true
+// authorize decides whether entry.Destination may be reached under the
+// policy set of entry.User and the destination rate limit, and logs the decision as a
+// connection_attempt built on entry. The decision carries the matching
+// allowlist rule when there is one, even in discovery mode, and its rule and
+// policy are recorded in entry for the events that follow.
+func (p *ProxyServer) authorize(base *LogEntry) Decision {
+	d := p.isAllowedBy(p.policyFor(base.User), base.Destination)
+	d.attribute(base)
+
+	entry := *base
+	entry.Level = LogLevelInfo
+	entry.Event = "connection_attempt"
+	if d.Allowed {
+		if limited := p.checkDestinationLimit(d); limited != nil {
+			limited.refuse(&d)
+			entry.Level = LogLevelWarning
+			entry.Extra = limited.extra()
+		}
+	}
+	d.apply(&entry)
+	p.logAttempt(entry)
+	if d.limited != nil {
+		p.logRateLimited(entry, d.limited)
+	}
+
+	// Shadow policies are drafts of the top-level lists
+	if d.Allowed && d.Policy == "" {
+		p.checkShadows(entry, d.rule)
 	}
+	return d
+}
 
-	// Check if just the hostname is in allowlist (allows any port)
-	host, _, err := net.SplitHostPort(hostPort)
-	if err == nil && p.allowlist[host] {
+// logAttempt logs a connection_attempt entry and counts it in the metrics
+func (p *ProxyServer) logAttempt(entry LogEntry) {
+	p.logger.Log(entry)
+	p.metrics.connectionAttempt(entry)
+}
+
+// logDialFailure logs a failed dial as a connection_attempt built on entry
+// and reports whether it failed because the destination resolved to a
+// blocked address
+func (p *ProxyServer) logDialFailure(entry LogEntry, addr *net.IPAddr, err error) bool {
+	entry.Event = "connection_attempt"
+
+	var blocked *blockedIPError
+	if errors.As(err, &blocked) {
+		entry.Level = LogLevelInfo
+		blocked.decision(entry.Destination).apply(&entry)
+		p.logAttempt(entry)
 		return true
 	}
 
+	failure := classifyDialError(err)
+	entry.Level = LogLevelError
+	entry.Action = failure.Action
+	entry.ResolvedIP = ipString(addr)
+	entry.Error = err.Error()
+	entry.ErrorClass = failure.Class
+	p.logAttempt(entry)
 	return false
 }
 
+// dialFailed logs a failed dial and answers the client: 403 with the
+// decision when the destination resolved to a blocked address, otherwise 502,
+// or 504 for a timeout, with the error class in X-Proxy-Error-Class
+func (p *ProxyServer) dialFailed(w http.ResponseWriter, entry LogEntry, addr *net.IPAddr, err error) {
+	if p.logDialFailure(entry, addr, err) {
+		var blocked *blockedIPError
+		errors.As(err, &blocked)
+		refuse(w, blocked.decision(entry.Destination))
+		return
+	}
+	failure := classifyDialError(err)
+	w.Header().Set("X-Proxy-Error-Class", failure.Class)
+	http.Error(w, http.StatusText(failure.Status)+": "+failure.Class, failure.Status)
+}
+
+// ServeHTTP routes CONNECT requests to handleConnect and absolute-form
+// requests ("GET http://host/path") to handleForward
+func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		p.handleConnect(w, r)
+	case r.URL.IsAbs():
+		p.handleForward(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // handleConnect handles HTTP CONNECT method for HTTPS tunneling
 func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodConnect {
@@ -159,29 +400,42 @@ func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	destHost := r.Host
+	process := requestProcess(r)
+	base := newClientEntry("connect", process)
+	base.Destination = destHost
+	if limited := p.limitClient(base); limited != nil {
+		tooManyRequests(w, limited)
+		return
+	}
+	process.identify(&base)
+	if !p.authenticateHTTP(w, r, &base) {
+		return
+	}
 
-	// In discovery mode, allow all connections and log them
-	if p.discoveryMode {
-		p.logger.ConnectionAttempt(destHost, "allowed_discovery", nil)
-	} else {
-		// Check allowlist in normal mode
-		if !p.isAllowed(destHost) {
-			p.logger.ConnectionAttempt(destHost, "blocked", nil)
-			http.Error(w, "Forbidden: Destination not allowed", http.StatusForbidden)
-			return
-		}
-		p.logger.ConnectionAttempt(destHost, "allowed", nil)
+	decision := p.authorize(&base)
+	if decision.limited != nil {
+		tooManyRequests(w, decision.limited)
+		return
+	}
+	if !decision.Allowed {
+		refuse(w, decision)
+		return
 	}
 
-	// Connect to the destination
-	destConn, err := net.DialTimeout("tcp", destHost, 10*time.Second)
+	// Resolve, vet and connect to the destination
+	destConn, destIP, err := p.dialDestination(r.Context(), p.policyFor(base.User), destHost)
 	if err != nil {
-		p.logger.ConnectionAttempt(destHost, "connection_failed", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		p.dialFailed(w, base, destIP, err)
 		return
 	}
 	defer destConn.Close()
 
+	if p.isClosing() {
+		p.logNotStarted(base, destIP)
+		http.Error(w, "Service Unavailable: proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Hijack the client connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -189,16 +443,76 @@ func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, clientBuf, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
 
+	// Shutdown may have begun since the check above; a tunnel is only
+	// established once it is tracked
+	tracked, ok := p.trackTunnel(clientConn, destConn)
+	if !ok {
+		p.logNotStarted(base, destIP)
+		clientConn.Write([]byte(shutdownResponse))
+		return
+	}
+
 	// Send 200 Connection Established to client
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
+	// Read through the hijacked buffer in case the client sent data early
+	p.tunnel(base, tracked, decision.rule, clientConn, clientBuf.Reader, destConn, destIP)
+}
+
+// tunnel copies bytes in both directions until either side closes or one of
+// the tunnel's timeouts passes, then logs connection_closed built on entry
+// with the bytes copied each way, how long the tunnel lasted and which side
+// ended it. Client data is read from clientReader, which wraps clientConn.
+// rule is the allowlist rule that permitted the tunnel, if any, and tracked
+// its registration from trackTunnel, which tunnel releases.
+func (p *ProxyServer) tunnel(entry LogEntry, tracked *trackedTunnel, rule *hostRule, clientConn net.Conn, clientReader *bufio.Reader, destConn net.Conn, destIP *net.IPAddr) {
+	started := time.Now()
+	p.metrics.tunnelOpened()
+
+	var sent, received uint64
+	upstream := &countingWriter{Writer: destConn, count: &sent, total: p.metrics.byteCounter(directionClientToDest)}
+	downstream := &countingWriter{Writer: clientConn, count: &received, total: p.metrics.byteCounter(directionDestToClient)}
+
+	// The first copy to stop decides which side closed the tunnel; the
+	// other one then fails because its connection was closed underneath it
+	var once sync.Once
+	var closedBy, closeReason string
+	var closeErr error
+	finish := func(side, reason string, err error) {
+		once.Do(func() { closedBy, closeReason, closeErr = side, reason, err })
+	}
+
+	timeouts := p.timeouts.forRule(rule)
+	if timeouts.MaxLifetime > 0 {
+		lifetime := time.AfterFunc(timeouts.MaxLifetime, func() {
+			finish("proxy", "max_lifetime", nil)
+			clientConn.Close()
+			destConn.Close()
+		})
+		defer lifetime.Stop()
+	}
+	activity := newTunnelActivity(timeouts.Idle)
+
+	// stopped records a copy that the proxy ended itself
+	stopped := func(reason string, err error) {
+		var quota *quotaError
+		if errors.As(err, &quota) {
+			p.logQuotaExceeded(entry, rule, quota)
+		}
+		finish("proxy", reason, err)
+	}
+	var traffic *trafficPolicy
+	if rule != nil {
+		traffic = rule.Traffic
+	}
+
 	// Bidirectional copy between client and destination
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -206,61 +520,233 @@ func (p *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	// Client -> Destination
 	go func() {
 		defer wg.Done()
-		io.Copy(destConn, clientConn)
-		destConn.Close()
+		defer destConn.Close()
+		if reason := p.inspectClient(entry, rule, clientConn, clientReader, upstream); reason != "" {
+			finish("proxy", reason, nil)
+			clientConn.Close()
+			return
+		}
+		reason, err := activity.copy(upstream, clientReader, clientConn, traffic.shaper(directionClientToDest))
+		if reason != "" {
+			stopped(reason, err)
+			clientConn.Close()
+			return
+		}
+		finish("client", "", err)
 	}()
 
 	// Destination -> Client
 	go func() {
 		defer wg.Done()
-		io.Copy(clientConn, destConn)
+		reason, err := activity.copy(downstream, destConn, destConn, traffic.shaper(directionDestToClient))
+		if reason != "" {
+			stopped(reason, err)
+		} else {
+			finish("destination", "", err)
+		}
 		clientConn.Close()
 	}()
 
 	wg.Wait()
-	p.logger.Log(LogEntry{
-		Level:       LogLevelInfo,
-		Event:       "connection_closed",
-		Destination: destHost,
-	})
+	duration := time.Since(started)
+	if p.untrackTunnel(tracked) {
+		closedBy, closeReason, closeErr = "proxy", "shutdown", nil
+	}
+	p.metrics.tunnelClosed(duration)
+
+	entry.Level = LogLevelInfo
+	entry.Event = "connection_closed"
+	entry.ResolvedIP = ipString(destIP)
+	entry.BytesSent = atomic.LoadUint64(&sent)
+	entry.BytesReceived = atomic.LoadUint64(&received)
+	entry.DurationMs = duration.Milliseconds()
+	entry.ClosedBy = closedBy
+	entry.Reason = closeReason
+	if closeErr != nil {
+		entry.Error = closeErr.Error()
+	}
+	p.logger.Log(entry)
 }
 
-// Start starts the proxy server
-func (p *ProxyServer) Start() error {
-	server := &http.Server{
-		Addr:    p.listen,
-		Handler: http.HandlerFunc(p.handleConnect),
+// inspectClient runs the checks that look at the start of the client stream
+// before it is copied to the destination: the protocol required by rule and,
+// in builds that enable it, SNI verification. Bytes the checks consume are
+// written to upstream. It returns why the tunnel must be closed, or "" to
+// carry on.
+func (p *ProxyServer) inspectClient(entry LogEntry, rule *hostRule, clientConn net.Conn, clientReader *bufio.Reader, upstream io.Writer) string {
+	if rule != nil && rule.Require != "" && !p.checkProtocol(entry, rule, clientConn, clientReader) {
+		return "protocol_violation"
+	}
+	if p.verifySNI && !p.checkSNI(entry, clientConn, clientReader, upstream) {
+		return "sni_mismatch"
 	}
+	return ""
+}
+
+// serverAddr returns the proxy address a request arrived on, or "" if the
+// server did not record it
+func serverAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return ""
+}
+
+// newConnectionID returns a random identifier that ties together the log
+// entries of one tunnel or forwarded request
+func newConnectionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("t%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// ipString formats an optional address for logging
+func ipString(addr *net.IPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
 
+// Start listens on the configured addresses and serves until Shutdown is
+// called, after which it returns nil
+func (p *ProxyServer) Start() error {
 	mode := "RESTRICTED"
 	if p.discoveryMode {
 		mode = "DISCOVERY"
 	}
 
+	message := fmt.Sprintf("Mode: %s, Listen: %s", mode, p.listen)
+	if p.verifySNI {
+		message += ", SNI Verification: enabled"
+	}
+	if p.socksListen != "" {
+		message += fmt.Sprintf(", SOCKS5 Listen: %s", p.socksListen)
+	}
+	if p.metricsListen != "" {
+		message += fmt.Sprintf(", Metrics Listen: %s", p.metricsListen)
+	}
+	for _, policy := range p.shadows {
+		message += fmt.Sprintf(", Shadow Policy: %s", policy.Name)
+	}
+	if p.auth != nil {
+		message += fmt.Sprintf(", Authentication: %d users", len(p.auth.users))
+	}
 	p.logger.Log(LogEntry{
 		Level:        LogLevelInfo,
 		Event:        "proxy_starting",
-		Message:      fmt.Sprintf("Mode: %s, Listen: %s", mode, p.listen),
-		AllowedCount: len(p.allowlist),
+		Message:      message,
+		AllowedCount: p.allowlist.Len(),
+		Extra:        currentBuild().logFields(),
 	})
 
-	// Log allowlist entries
-	for entry := range p.allowlist {
+	// Log allowlist and denylist entries
+	for _, rule := range p.allowlist.rules {
 		p.logger.Log(LogEntry{
 			Level:       LogLevelDebug,
 			Event:       "allowlist_entry",
-			Destination: entry,
+			Destination: rule.Entry,
+		})
+	}
+	for _, rule := range p.denylist.rules {
+		p.logger.Log(LogEntry{
+			Level:       LogLevelDebug,
+			Event:       "denylist_entry",
+			Destination: rule.Entry,
 		})
 	}
 
-	return server.ListenAndServe()
+	listener, err := net.Listen("tcp", p.listen)
+	if err != nil {
+		return err
+	}
+
+	var socksListener net.Listener
+	if p.socksListen != "" {
+		if socksListener, err = net.Listen("tcp", p.socksListen); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	if p.metricsListen != "" {
+		metricsListener, err := net.Listen("tcp", p.metricsListen)
+		if err != nil {
+			listener.Close()
+			if socksListener != nil {
+				socksListener.Close()
+			}
+			return err
+		}
+		go p.serveMetrics(metricsListener)
+	}
+
+	return p.Serve(listener, socksListener)
+}
+
+// Serve accepts HTTP proxy clients on listener and, when socksListener is
+// not nil, SOCKS5 clients on socksListener. It returns nil once Shutdown has
+// been called, or the first error from either listener otherwise.
+func (p *ProxyServer) Serve(listener, socksListener net.Listener) error {
+	server := p.newHTTPServer()
+
+	// Both listeners draw on one pool of connection slots
+	var slots chan struct{}
+	if p.limits.MaxConnections > 0 {
+		slots = make(chan struct{}, p.limits.MaxConnections)
+	}
+	listener = p.limitConnections(listener, slots, "http")
+	if socksListener != nil {
+		socksListener = p.limitConnections(socksListener, slots, "socks5")
+	}
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		listener.Close()
+		if socksListener != nil {
+			socksListener.Close()
+		}
+		return nil
+	}
+	p.server = server
+	p.socksListener = socksListener
+	p.mu.Unlock()
+
+	errs := make(chan error, 2)
+	if socksListener != nil {
+		go func() { errs <- p.serveSOCKS(socksListener) }()
+	}
+	go func() { errs <- server.Serve(listener) }()
+
+	err := <-errs
+	if p.isClosing() {
+		return nil
+	}
+	return err
 }
 
 func main() {
 	// Command line flags
 	listen := flag.String("listen", "localhost:9091", "Address to listen on (e.g., localhost:9091 or :8080)")
+	socksListen := flag.String("socks-listen", "", "Optional address for a SOCKS5 listener (e.g., localhost:1080)")
+	metricsListen := flag.String("metrics-listen", "", "Optional address for a Prometheus metrics listener serving /metrics (e.g., localhost:9092)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long to wait for active connections to finish on SIGTERM or SIGINT before closing them")
+	showVersion := flag.Bool("version", false, "Print the binary's SHA256, embedded allowlist digest and build details, then exit")
+	showConfig := flag.Bool("show-config", false, "Print the embedded allowlist.yaml exactly as compiled in, then exit")
 	flag.Parse()
 
+	if *showVersion {
+		writeVersion(os.Stdout, currentBuild())
+		return
+	}
+	if *showConfig {
+		os.Stdout.Write(allowlistYAML)
+		return
+	}
+
 	logger := NewLogger(os.Stdout)
 
 	proxy, err := NewProxyServer(*listen, logger)
@@ -268,9 +754,38 @@ func main() {
 		logger.Error("initialization_failed", "Failed to create proxy server", err.Error())
 		os.Exit(1)
 	}
+	proxy.socksListen = *socksListen
+	proxy.metricsListen = *metricsListen
 
-	if err := proxy.Start(); err != nil {
-		logger.Error("server_failed", "Proxy server failed", err.Error())
-		os.Exit(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	errs := make(chan error, 1)
+	go func() { errs <- proxy.Start() }()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			logger.Error("server_failed", "Proxy server failed", err.Error())
+			os.Exit(1)
+		}
+	case sig := <-signals:
+		// A second signal gives up on draining
+		go func() {
+			sig := <-signals
+			closed := proxy.closeTunnels()
+			logger.Log(LogEntry{
+				Level:   LogLevelWarning,
+				Event:   "proxy_stopped",
+				Message: "Stopped without draining after a second " + sig.String(),
+				Extra: map[string]interface{}{
+					"connections_closed": closed,
+					"forced":             true,
+				},
+			})
+			os.Exit(1)
+		}()
+		proxy.Shutdown(sig.String(), *drainTimeout)
+		<-errs
 	}
 }
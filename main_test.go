@@ -1,26 +1,41 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// testConfig parses the current embedded configuration, failing the test
+// if it does not parse
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return config
+}
+
 func TestLoadAllowlist(t *testing.T) {
-	allowlist, err := loadAllowlist()
+	allowlist, err := loadAllowlist(testConfig(t))
 	if err != nil {
 		t.Fatalf("Failed to load allowlist: %v", err)
 	}
 
-	if len(allowlist) == 0 {
+	if allowlist.Len() == 0 {
 		t.Error("Allowlist is empty")
 	}
 
@@ -32,9 +47,9 @@ func TestLoadAllowlist(t *testing.T) {
 		"api.github.com:443": true,
 	}
 
-	for _, entry := range allowlist {
-		if expectedEntries[entry] {
-			delete(expectedEntries, entry)
+	for _, rule := range allowlist.rules {
+		if expectedEntries[rule.Entry] {
+			delete(expectedEntries, rule.Entry)
 		}
 	}
 
@@ -50,7 +65,7 @@ func TestLoadAllowlistInvalidYAML(t *testing.T) {
 	// Temporarily replace with invalid YAML
 	allowlistYAML = []byte("invalid: yaml: content: [")
 
-	_, err := loadAllowlist()
+	_, err := loadConfig()
 	if err == nil {
 		t.Error("Expected error when parsing invalid YAML")
 	}
@@ -74,7 +89,7 @@ func TestNewProxyServer(t *testing.T) {
 		t.Error("Logger is nil")
 	}
 
-	if len(proxy.allowlist) == 0 {
+	if proxy.allowlist.Len() == 0 {
 		t.Error("Allowlist is empty")
 	}
 
@@ -141,7 +156,7 @@ func TestIsAllowed(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := proxy.isAllowed(tt.hostPort)
+			result := proxy.isAllowed(tt.hostPort).Allowed
 			if result != tt.allowed {
 				t.Errorf("isAllowed(%s) = %v, want %v", tt.hostPort, result, tt.allowed)
 			}
@@ -172,24 +187,6 @@ func TestLogger(t *testing.T) {
 	if entry.Message != "test message" {
 		t.Errorf("Expected message 'test message', got %s", entry.Message)
 	}
-
-	// Test ConnectionAttempt
-	logger.ConnectionAttempt("example.com:443", "allowed", nil)
-	output = buf.String()
-
-	if err := json.Unmarshal([]byte(output), &entry); err != nil {
-		t.Fatalf("Failed to parse log output: %v", err)
-	}
-
-	if entry.Event != "connection_attempt" {
-		t.Errorf("Expected event connection_attempt, got %s", entry.Event)
-	}
-	if entry.Destination != "example.com:443" {
-		t.Errorf("Expected destination example.com:443, got %s", entry.Destination)
-	}
-	if entry.Action != "allowed" {
-		t.Errorf("Expected action allowed, got %s", entry.Action)
-	}
 }
 
 func TestHandleConnectMethodNotAllowed(t *testing.T) {
@@ -298,6 +295,74 @@ func TestDiscoveryMode(t *testing.T) {
 	}
 }
 
+func TestHandleConnectDeniedByRule(t *testing.T) {
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+	allowlistYAML = []byte(`allowlist:
+  - .corp.example
+denylist:
+  - admin.corp.example
+  - 169.254.169.254
+`)
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+	proxy, err := NewProxyServer("localhost:8080", logger)
+	if err != nil {
+		t.Fatalf("Failed to create proxy server: %v", err)
+	}
+
+	for _, discovery := range []bool{false, true} {
+		buf.Reset()
+		proxy.discoveryMode = discovery
+
+		req := httptest.NewRequest("CONNECT", "http://admin.corp.example:443", nil)
+		req.Host = "admin.corp.example:443"
+		w := httptest.NewRecorder()
+
+		proxy.handleConnect(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("discovery=%v: expected status %d, got %d", discovery, http.StatusForbidden, w.Code)
+		}
+
+		var entry LogEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Failed to parse log output: %v", err)
+		}
+		if entry.Action != "denied_by_rule" {
+			t.Errorf("discovery=%v: expected action denied_by_rule, got %s", discovery, entry.Action)
+		}
+		if entry.Rule != "admin.corp.example" {
+			t.Errorf("discovery=%v: expected rule admin.corp.example, got %s", discovery, entry.Rule)
+		}
+	}
+
+	if d := proxy.isAllowed("www.corp.example:443"); !d.Allowed || d.Reason != reasonAllowedByRule {
+		t.Errorf("www.corp.example should still be allowed, got %+v", d)
+	}
+	if d := proxy.isAllowed("169.254.169.254:80"); d.Allowed || d.Reason != reasonDeniedByRule {
+		t.Errorf("169.254.169.254 should be denied, got %+v", d)
+	}
+}
+
+func TestLoadDenylistInvalidEntry(t *testing.T) {
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+	allowlistYAML = []byte(`allowlist:
+  - example.com
+denylist:
+  - "*.com"
+`)
+
+	if _, err := loadDenylist(testConfig(t)); err == nil {
+		t.Error("Expected error for invalid denylist entry")
+	}
+	if _, err := NewProxyServer("localhost:8080", NewLogger(os.Stdout)); err == nil {
+		t.Error("Expected NewProxyServer to reject invalid denylist entry")
+	}
+}
+
 func TestConfigStructure(t *testing.T) {
 	yamlContent := `allowlist:
   - example.com
@@ -314,7 +379,7 @@ func TestConfigStructure(t *testing.T) {
 		t.Errorf("Expected 2 entries, got %d", len(config.Allowlist))
 	}
 
-	if config.Allowlist[0] != "example.com" {
+	if config.Allowlist[0].Host != "example.com" {
 		t.Errorf("Expected first entry to be example.com, got %s", config.Allowlist[0])
 	}
 }
@@ -344,7 +409,7 @@ func TestProxyServerIntegration(t *testing.T) {
 	}
 
 	// Check that test server is in allowlist
-	if !proxy.isAllowed(destHost) {
+	if !proxy.isAllowed(destHost).Allowed {
 		t.Errorf("Test server %s should be in allowlist", destHost)
 	}
 
@@ -352,6 +417,249 @@ func TestProxyServerIntegration(t *testing.T) {
 	allowlistYAML = originalAllowlist
 }
 
+// connectThrough sends a CONNECT for dest to the proxy at proxyAddr and
+// returns the connection, a reader positioned after the response headers and
+// the response status code
+func connectThrough(t *testing.T, proxyAddr, dest string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	return conn, reader, resp.StatusCode
+}
+
+// logEntries parses every JSON log line written to buf
+func logEntries(t *testing.T, buf *bytes.Buffer) []LogEntry {
+	t.Helper()
+	var entries []LogEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to parse log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// syncBuffer is a bytes.Buffer safe for the proxy's handler goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// snapshot copies the buffered output so it can be inspected
+func (b *syncBuffer) snapshot() *bytes.Buffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.NewBuffer(append([]byte(nil), b.buf.Bytes()...))
+}
+
+// waitForEvent polls logs until an entry with the given event appears
+func waitForEvent(t *testing.T, logs *syncBuffer, event string) LogEntry {
+	t.Helper()
+	return waitForEntry(t, logs, event, func(LogEntry) bool { return true })
+}
+
+// waitForEntry polls logs until an entry with the given event satisfies match
+func waitForEntry(t *testing.T, logs *syncBuffer, event string, match func(LogEntry) bool) LogEntry {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		for _, entry := range logEntries(t, logs.snapshot()) {
+			if entry.Event == event && match(entry) {
+				return entry
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", event)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleConnectTunnelsToAllowlistedIP(t *testing.T) {
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer destServer.Close()
+	destHost := strings.TrimPrefix(destServer.URL, "http://")
+
+	proxy := newTestProxy(t, "allowlist:\n  - "+destHost+"\n")
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxy.handleConnect))
+	defer proxyServer.Close()
+
+	conn, reader, status := connectThrough(t, proxyServer.Listener.Addr().String(), destHost)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", destHost)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read tunneled response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "OK" {
+		t.Errorf("Expected body OK, got %q", body)
+	}
+	conn.Close()
+
+	closed := waitForEvent(t, &logs, "connection_closed")
+	if !strings.HasPrefix(destHost, closed.ResolvedIP+":") {
+		t.Errorf("Expected resolved_ip of %s, got %q", destHost, closed.ResolvedIP)
+	}
+}
+
+func TestTunnelCloseStats(t *testing.T) {
+	t.Run("client closes", func(t *testing.T) {
+		proxy, logs, dest := newEchoTunnelProxy(t)
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		conn, reader, status := connectThrough(t, proxyServer.Listener.Addr().String(), dest)
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		conn.Write([]byte("hello"))
+		if _, err := io.ReadFull(reader, make([]byte, 5)); err != nil {
+			t.Fatalf("Failed to read echo: %v", err)
+		}
+		conn.Close()
+
+		closed := waitForEvent(t, logs, "connection_closed")
+		if closed.ClosedBy != "client" || closed.BytesSent != 5 || closed.BytesReceived != 5 {
+			t.Errorf("Unexpected connection_closed entry: %+v", closed)
+		}
+		if closed.Error != "" || closed.Reason != "" {
+			t.Errorf("Expected a clean close, got reason %q error %q", closed.Reason, closed.Error)
+		}
+	})
+
+	t.Run("destination closes", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			conn.Write([]byte("bye\n"))
+			conn.Close()
+		}()
+
+		dest := listener.Addr().String()
+		proxy := newTestProxy(t, "allowlist:\n  - "+dest+"\n")
+		var logs syncBuffer
+		proxy.logger = NewLogger(&logs)
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		conn, reader, status := connectThrough(t, proxyServer.Listener.Addr().String(), dest)
+		defer conn.Close()
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		if line, err := reader.ReadString('\n'); err != nil || line != "bye\n" {
+			t.Fatalf("Expected bye, got %q (%v)", line, err)
+		}
+
+		closed := waitForEvent(t, &logs, "connection_closed")
+		if closed.ClosedBy != "destination" || closed.BytesSent != 0 || closed.BytesReceived != 4 {
+			t.Errorf("Unexpected connection_closed entry: %+v", closed)
+		}
+		if closed.DurationMs < 50 {
+			t.Errorf("Expected duration of at least 50ms, got %d", closed.DurationMs)
+		}
+	})
+}
+
+func TestConnectionIDCorrelatesLifecycle(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyAddr := proxyServer.Listener.Addr().String()
+
+	conn, _, status := connectThrough(t, proxyAddr, dest)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	clientAddr := conn.LocalAddr().String()
+	conn.Close()
+	closed := waitForEvent(t, logs, "connection_closed")
+
+	blocked, _, _ := connectThrough(t, proxyAddr, "blocked.example:443")
+	blocked.Close()
+	denied := waitForEntry(t, logs, "connection_attempt", func(e LogEntry) bool { return e.Action == "blocked" })
+
+	attempt := waitForEntry(t, logs, "connection_attempt", func(e LogEntry) bool { return e.Action == "allowed" })
+	if attempt.ConnectionID == "" || attempt.ConnectionID != closed.ConnectionID {
+		t.Errorf("Expected attempt and close to share a connection_id, got %q and %q", attempt.ConnectionID, closed.ConnectionID)
+	}
+	if attempt.ClientAddr != clientAddr || closed.ClientAddr != clientAddr {
+		t.Errorf("Expected client_addr %s, got %q and %q", clientAddr, attempt.ClientAddr, closed.ClientAddr)
+	}
+	if denied.ConnectionID == "" || denied.ConnectionID == attempt.ConnectionID {
+		t.Errorf("Expected a distinct connection_id for a new connection, got %q", denied.ConnectionID)
+	}
+	if denied.ClientAddr != blocked.LocalAddr().String() {
+		t.Errorf("Expected client_addr %s, got %q", blocked.LocalAddr(), denied.ClientAddr)
+	}
+}
+
+func TestHandleConnectBlocksForbiddenResolution(t *testing.T) {
+	var buf bytes.Buffer
+	proxy := newTestProxy(t, "allowlist:\n  - rebind.example.com\n")
+	proxy.logger = NewLogger(&buf)
+	proxy.resolver = staticResolver{"rebind.example.com": {"127.0.0.1"}}
+
+	req := httptest.NewRequest("CONNECT", "http://rebind.example.com:443", nil)
+	req.Host = "rebind.example.com:443"
+	w := httptest.NewRecorder()
+
+	proxy.handleConnect(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	entries := logEntries(t, &buf)
+	last := entries[len(entries)-1]
+	if last.Action != "blocked_resolved_ip" {
+		t.Errorf("Expected action blocked_resolved_ip, got %s", last.Action)
+	}
+	if last.ResolvedIP != "127.0.0.1" {
+		t.Errorf("Expected resolved_ip 127.0.0.1, got %s", last.ResolvedIP)
+	}
+	if last.Rule != "127.0.0.0/8" {
+		t.Errorf("Expected rule 127.0.0.0/8, got %s", last.Rule)
+	}
+}
+
 func TestLogEntryFields(t *testing.T) {
 	var buf bytes.Buffer
 	logger := NewLogger(&buf)
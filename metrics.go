@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnel byte directions used as the direction label
+const (
+	directionClientToDest = "client_to_destination"
+	directionDestToClient = "destination_to_client"
+)
+
+// tunnelDurationBuckets are the upper bounds, in seconds, of the tunnel
+// duration histogram
+var tunnelDurationBuckets = []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600}
+
+// attemptKey labels a connection attempt counter
+type attemptKey struct {
+	action   string
+	protocol string
+	rule     string
+}
+
+// metrics collects proxy activity for the Prometheus endpoint. Rule labels
+// only ever hold entries from the embedded configuration or forbidden
+// ranges, so the number of series stays bounded.
+type metrics struct {
+	mu       sync.Mutex
+	attempts map[attemptKey]uint64
+
+	// durations holds cumulative bucket counts, with the +Inf bucket last
+	durations     []uint64
+	durationSum   float64
+	durationCount uint64
+
+	// rateLimited counts connections refused by each rate limit
+	rateLimitedClient      uint64
+	rateLimitedDestination uint64
+
+	activeTunnels int64
+	bytesToDest   uint64
+	bytesToClient uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		attempts:  make(map[attemptKey]uint64),
+		durations: make([]uint64, len(tunnelDurationBuckets)+1),
+	}
+}
+
+// connectionAttempt counts a connection_attempt log entry
+func (m *metrics) connectionAttempt(entry LogEntry) {
+	key := attemptKey{action: entry.Action, protocol: entry.Protocol, rule: entry.Rule}
+	m.mu.Lock()
+	m.attempts[key]++
+	m.mu.Unlock()
+}
+
+// rateLimited counts a connection refused by limit
+func (m *metrics) rateLimited(limit string) {
+	if limit == rateLimitClient {
+		atomic.AddUint64(&m.rateLimitedClient, 1)
+	} else {
+		atomic.AddUint64(&m.rateLimitedDestination, 1)
+	}
+}
+
+// tunnelOpened increments the active tunnel gauge
+func (m *metrics) tunnelOpened() {
+	atomic.AddInt64(&m.activeTunnels, 1)
+}
+
+// tunnelClosed decrements the active tunnel gauge and observes how long the
+// tunnel was open
+func (m *metrics) tunnelClosed(duration time.Duration) {
+	atomic.AddInt64(&m.activeTunnels, -1)
+
+	seconds := duration.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range tunnelDurationBuckets {
+		if seconds <= bound {
+			m.durations[i]++
+		}
+	}
+	m.durations[len(tunnelDurationBuckets)]++
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+// byteCounter returns the counter for bytes copied in direction
+func (m *metrics) byteCounter(direction string) *uint64 {
+	if direction == directionClientToDest {
+		return &m.bytesToDest
+	}
+	return &m.bytesToClient
+}
+
+// countingWriter adds every byte written through it to a per-tunnel counter
+// and a shared one, so long-lived tunnels show up in the metrics while they
+// are still open
+type countingWriter struct {
+	io.Writer
+	count *uint64
+	total *uint64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddUint64(w.count, uint64(n))
+	atomic.AddUint64(w.total, uint64(n))
+	return n, err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	keys := make([]attemptKey, 0, len(m.attempts))
+	for key := range m.attempts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].action != keys[j].action {
+			return keys[i].action < keys[j].action
+		}
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].rule < keys[j].rule
+	})
+
+	writeHeader(&b, "restricted_proxy_connection_attempts_total", "counter", "Connection attempts by outcome, client protocol and the rule that decided them.")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "restricted_proxy_connection_attempts_total{action=%s,protocol=%s,rule=%s} %d\n",
+			quoteLabel(key.action), quoteLabel(key.protocol), quoteLabel(key.rule), m.attempts[key])
+	}
+
+	writeHeader(&b, "restricted_proxy_tunnel_duration_seconds", "histogram", "How long tunnels stayed open.")
+	for i, bound := range tunnelDurationBuckets {
+		fmt.Fprintf(&b, "restricted_proxy_tunnel_duration_seconds_bucket{le=%s} %d\n",
+			quoteLabel(strconv.FormatFloat(bound, 'g', -1, 64)), m.durations[i])
+	}
+	fmt.Fprintf(&b, "restricted_proxy_tunnel_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durations[len(tunnelDurationBuckets)])
+	fmt.Fprintf(&b, "restricted_proxy_tunnel_duration_seconds_sum %s\n", strconv.FormatFloat(m.durationSum, 'g', -1, 64))
+	fmt.Fprintf(&b, "restricted_proxy_tunnel_duration_seconds_count %d\n", m.durationCount)
+	m.mu.Unlock()
+
+	writeHeader(&b, "restricted_proxy_rate_limited_total", "counter", "Connections refused by a rate limit, by limit.")
+	fmt.Fprintf(&b, "restricted_proxy_rate_limited_total{limit=%s} %d\n", quoteLabel(rateLimitClient), atomic.LoadUint64(&m.rateLimitedClient))
+	fmt.Fprintf(&b, "restricted_proxy_rate_limited_total{limit=%s} %d\n", quoteLabel(rateLimitDestination), atomic.LoadUint64(&m.rateLimitedDestination))
+
+	writeHeader(&b, "restricted_proxy_active_tunnels", "gauge", "Tunnels currently open.")
+	fmt.Fprintf(&b, "restricted_proxy_active_tunnels %d\n", atomic.LoadInt64(&m.activeTunnels))
+
+	writeHeader(&b, "restricted_proxy_tunnel_bytes_total", "counter", "Bytes copied through tunnels in each direction.")
+	fmt.Fprintf(&b, "restricted_proxy_tunnel_bytes_total{direction=%s} %d\n", quoteLabel(directionClientToDest), atomic.LoadUint64(&m.bytesToDest))
+	fmt.Fprintf(&b, "restricted_proxy_tunnel_bytes_total{direction=%s} %d\n", quoteLabel(directionDestToClient), atomic.LoadUint64(&m.bytesToClient))
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quoteLabel quotes a label value, escaping backslashes, quotes and newlines
+func quoteLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+// serveMetrics serves the metrics endpoint on listener until Shutdown
+func (p *ProxyServer) serveMetrics(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.metrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: p.limits.ReadHeaderTimeout}
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		listener.Close()
+		return
+	}
+	p.metricsServer = server
+	p.mu.Unlock()
+
+	if err := server.Serve(listener); err != nil && !p.isClosing() {
+		p.logger.Error("metrics_server_failed", "Metrics server failed", err.Error())
+	}
+}
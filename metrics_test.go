@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics fetches the metrics endpoint at addr
+func scrapeMetrics(t *testing.T, addr string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxyAddr, _ := serveTestProxy(t, proxy)
+	defer proxy.Shutdown("test", time.Second)
+
+	metricsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go proxy.serveMetrics(metricsListener)
+	metricsAddr := metricsListener.Addr().String()
+
+	conn, _, status := connectThrough(t, proxyAddr, dest)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+
+	// While open the tunnel is counted as active
+	if body := scrapeMetrics(t, metricsAddr); !strings.Contains(body, "restricted_proxy_active_tunnels 1\n") {
+		t.Errorf("Expected one active tunnel, got:\n%s", body)
+	}
+
+	conn.Close()
+	waitForEvent(t, logs, "connection_closed")
+
+	blocked, _, status := connectThrough(t, proxyAddr, "blocked.example:443")
+	blocked.Close()
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", status)
+	}
+
+	body := scrapeMetrics(t, metricsAddr)
+	for _, want := range []string{
+		"# TYPE restricted_proxy_connection_attempts_total counter\n",
+		`restricted_proxy_connection_attempts_total{action="allowed",protocol="connect",rule="` + dest + `"} 1` + "\n",
+		`restricted_proxy_connection_attempts_total{action="blocked",protocol="connect",rule=""} 1` + "\n",
+		"restricted_proxy_active_tunnels 0\n",
+		`restricted_proxy_tunnel_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"restricted_proxy_tunnel_duration_seconds_count 1\n",
+		`restricted_proxy_tunnel_bytes_total{direction="client_to_destination"} 5` + "\n",
+		`restricted_proxy_tunnel_bytes_total{direction="destination_to_client"} 5` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsCountsDialFailures(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	refusedHost := closed.Addr().String()
+	closed.Close()
+
+	proxy := newTestProxy(t, "allowlist:\n  - internal.example:443\n  - "+refusedHost+"\n")
+	var logs bytes.Buffer
+	proxy.logger = NewLogger(&logs)
+	proxy.resolver = staticResolver{"internal.example": {"10.0.0.5"}}
+
+	for _, host := range []string{"internal.example:443", refusedHost} {
+		req := httptest.NewRequest("CONNECT", "http://"+host, nil)
+		req.Host = host
+		proxy.handleConnect(httptest.NewRecorder(), req)
+	}
+
+	var body bytes.Buffer
+	proxy.metrics.WriteTo(&body)
+	for _, want := range []string{
+		`restricted_proxy_connection_attempts_total{action="blocked_resolved_ip",protocol="connect",rule="10.0.0.0/8"} 1`,
+		`restricted_proxy_connection_attempts_total{action="connection_refused",protocol="connect",rule="` + refusedHost + `"} 1`,
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("Metrics missing %q in:\n%s", want, body.String())
+		}
+	}
+
+	entries := logEntries(t, &logs)
+	last := entries[len(entries)-1]
+	if last.Action != "connection_refused" || last.Rule != refusedHost || last.RuleIndex == nil || *last.RuleIndex != 1 {
+		t.Errorf("Expected the refused dial to carry its rule, got %+v", last)
+	}
+}
+
+func TestMetricsDurationBuckets(t *testing.T) {
+	m := newMetrics()
+	m.tunnelOpened()
+	m.tunnelClosed(2 * time.Second)
+
+	var body bytes.Buffer
+	m.WriteTo(&body)
+	for _, want := range []string{
+		`restricted_proxy_tunnel_duration_seconds_bucket{le="1"} 0` + "\n",
+		`restricted_proxy_tunnel_duration_seconds_bucket{le="5"} 1` + "\n",
+		`restricted_proxy_tunnel_duration_seconds_bucket{le="3600"} 1` + "\n",
+		"restricted_proxy_tunnel_duration_seconds_sum 2\n",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("Metrics missing %q in:\n%s", want, body.String())
+		}
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	if got := quoteLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("quoteLabel() = %s", got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// errProcessLookupUnsupported is returned by lookupProcess on platforms
+// without a supported way to map sockets to processes
+var errProcessLookupUnsupported = errors.New("process lookup is not supported on this platform")
+
+// processInfo describes the local process that owns a client's socket. UID
+// may be known when PID is not, for example when the process belongs to
+// another user and its file descriptors cannot be read.
+type processInfo struct {
+	PID int
+	UID int
+	Exe string
+}
+
+// clientProcess looks up the process behind one client connection at most
+// once, however many requests arrive on it
+type clientProcess struct {
+	clientAddr, serverAddr string
+
+	once sync.Once
+	info *processInfo
+	err  error
+}
+
+// newClientProcess returns the lookup for a connection from clientAddr to the
+// proxy address serverAddr. Nothing is looked up until it is needed.
+func newClientProcess(clientAddr, serverAddr string) *clientProcess {
+	return &clientProcess{clientAddr: clientAddr, serverAddr: serverAddr}
+}
+
+func (c *clientProcess) lookup() (*processInfo, error) {
+	c.once.Do(func() { c.info, c.err = lookupProcess(c.clientAddr, c.serverAddr) })
+	return c.info, c.err
+}
+
+type clientProcessKey struct{}
+
+// withClientProcess is the HTTP server's ConnContext hook; it attaches one
+// clientProcess to every request on conn
+func withClientProcess(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, clientProcessKey{}, newClientProcess(conn.RemoteAddr().String(), conn.LocalAddr().String()))
+}
+
+// requestProcess returns the clientProcess of the connection r arrived on,
+// or a new one when the server did not attach it
+func requestProcess(r *http.Request) *clientProcess {
+	if process, ok := r.Context().Value(clientProcessKey{}).(*clientProcess); ok {
+		return process
+	}
+	return newClientProcess(r.RemoteAddr, serverAddr(r))
+}
+
+// newClientEntry starts the log entry shared by every event about one client
+// connection or request. The owning process is not looked up yet, so the
+// client rate limit can refuse a flood of connections without a /proc scan
+// for each; identify adds it once the client is let in.
+func newClientEntry(protocol string, process *clientProcess) LogEntry {
+	return LogEntry{
+		ConnectionID: newConnectionID(),
+		ClientAddr:   process.clientAddr,
+		Protocol:     protocol,
+	}
+}
+
+// identify adds the process that owns the client's socket to entry when the
+// client runs on this host; failing to find it only leaves those fields out
+func (c *clientProcess) identify(entry *LogEntry) {
+	info, err := c.lookup()
+	if err != nil {
+		return
+	}
+	uid := info.UID
+	entry.ClientUID = &uid
+	entry.ClientPID = info.PID
+	entry.ClientExe = info.Exe
+}
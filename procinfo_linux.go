@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"restricted-local-proxy/internal/procnet"
+)
+
+// procRoot is where the proc filesystem is mounted
+var procRoot = "/proc"
+
+// lookupProcess finds the process owning the TCP socket connected from
+// clientAddr to serverAddr. The socket's inode and UID come from
+// /proc/net/tcp and /proc/net/tcp6; the PID is the process with a file
+// descriptor for that inode, and Exe is where /proc/<pid>/exe points.
+func lookupProcess(clientAddr, serverAddr string) (*processInfo, error) {
+	client, err := parseTCPAddr(clientAddr)
+	if err != nil {
+		return nil, err
+	}
+	server, err := parseTCPAddr(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	inode, uid, err := findSocket(client, server)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &processInfo{UID: uid}
+	pid, ok := procnet.Owner(procRoot, inode)
+	if !ok {
+		return info, nil
+	}
+	info.PID = pid
+	info.Exe, _ = os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	return info, nil
+}
+
+// parseTCPAddr splits a host:port string with a literal IP
+func parseTCPAddr(hostPort string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", host)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: portNum}, nil
+}
+
+// findSocket returns the inode and owner UID of the socket whose local end
+// is local and whose remote end is remote. IPv4-mapped IPv6 addresses in
+// tcp6 match their IPv4 form.
+func findSocket(local, remote *net.TCPAddr) (uint64, int, error) {
+	sockets, err := procnet.Sockets(procRoot)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, socket := range sockets {
+		if sameAddr(socket.Local, local) && sameAddr(socket.Remote, remote) {
+			return socket.Inode, socket.UID, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no local socket for %s", local)
+}
+
+// sameAddr reports whether a and b are the same IP and port
+func sameAddr(a, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dialLoopback returns both ends of a loopback TCP connection
+func dialLoopback(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestLookupProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("/proc/net/tcp is not available")
+	}
+	client, server := dialLoopback(t)
+
+	info, err := lookupProcess(client.LocalAddr().String(), server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("lookupProcess failed: %v", err)
+	}
+	if info.PID != os.Getpid() || info.UID != os.Getuid() {
+		t.Errorf("Expected pid %d uid %d, got %+v", os.Getpid(), os.Getuid(), info)
+	}
+	exe, _ := os.Executable()
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil && info.Exe != resolved {
+		t.Errorf("Expected exe %s, got %s", resolved, info.Exe)
+	}
+
+	// The accepted end is a different socket and must not be confused with it
+	if _, err := lookupProcess(server.LocalAddr().String(), "127.0.0.1:1"); err == nil {
+		t.Error("Expected no socket for an unknown remote address")
+	}
+}
+
+func TestLookupProcessWithoutProc(t *testing.T) {
+	original := procRoot
+	defer func() { procRoot = original }()
+	procRoot = t.TempDir()
+
+	client, server := dialLoopback(t)
+	if _, err := lookupProcess(client.LocalAddr().String(), server.LocalAddr().String()); err == nil {
+		t.Error("Expected an error when /proc cannot be read")
+	}
+
+	process := newClientProcess(client.LocalAddr().String(), server.LocalAddr().String())
+	entry := newClientEntry("connect", process)
+	process.identify(&entry)
+	if entry.ClientPID != 0 || entry.ClientUID != nil || entry.ClientExe != "" {
+		t.Errorf("Expected no process fields, got %+v", entry)
+	}
+	if entry.ClientAddr != client.LocalAddr().String() || entry.ConnectionID == "" {
+		t.Errorf("Expected client address and connection ID to be kept, got %+v", entry)
+	}
+}
+
+func TestClientProcessLookedUpOnce(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("/proc/net/tcp is not available")
+	}
+	client, server := dialLoopback(t)
+
+	// Every request on one connection shares the first lookup
+	ctx := withClientProcess(context.Background(), server)
+	first := httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx)
+	second := httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx)
+	if requestProcess(first) != requestProcess(second) {
+		t.Fatal("Expected requests on one connection to share a clientProcess")
+	}
+	entry := newClientEntry("http", requestProcess(first))
+	requestProcess(first).identify(&entry)
+	if entry.ClientPID != os.Getpid() {
+		t.Fatalf("Expected pid %d, got %+v", os.Getpid(), entry)
+	}
+
+	original := procRoot
+	defer func() { procRoot = original }()
+	procRoot = t.TempDir()
+	entry = newClientEntry("http", requestProcess(second))
+	requestProcess(second).identify(&entry)
+	if entry.ClientPID != os.Getpid() || entry.ClientAddr != client.LocalAddr().String() {
+		t.Errorf("Expected the cached lookup to be reused, got %+v", entry)
+	}
+}
+
+func TestHandleConnectLogsClientProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("/proc/net/tcp is not available")
+	}
+	proxy := newTestProxy(t, "allowlist:\n  - example.com:443\n")
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, _, status := connectThrough(t, proxyServer.Listener.Addr().String(), "blocked.example:443")
+	conn.Close()
+	if status != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", status)
+	}
+
+	entry := waitForEvent(t, &logs, "connection_attempt")
+	if entry.ClientPID != os.Getpid() || entry.ClientUID == nil || *entry.ClientUID != os.Getuid() || entry.ClientExe == "" {
+		t.Errorf("Expected this test process in the log entry, got %+v", entry)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// lookupProcess is only implemented on Linux
+func lookupProcess(clientAddr, serverAddr string) (*processInfo, error) {
+	return nil, errProcessLookupUnsupported
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+)
+
+// Protocols recognized at the start of a client stream
+const (
+	protocolTLS     = "tls"
+	protocolSSH     = "ssh"
+	protocolHTTP    = "http"
+	protocolUnknown = "unknown"
+	protocolNone    = "none" // the client sent nothing before the sniff timeout
+)
+
+// sniffTimeout bounds how long the proxy waits for a client's first bytes
+// when an entry requires a protocol
+const sniffTimeout = 10 * time.Second
+
+// httpMethodPrefixes are the first four bytes of common HTTP/1.x requests
+var httpMethodPrefixes = [][]byte{
+	[]byte("GET "), []byte("HEAD"), []byte("POST"), []byte("PUT "),
+	[]byte("DELE"), []byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"),
+}
+
+// detectProtocol classifies a client stream from its first bytes without
+// consuming them: a TLS handshake record, an SSH identification banner or an
+// HTTP/1.x request line
+func detectProtocol(r *bufio.Reader) string {
+	first, err := r.Peek(1)
+	if err != nil {
+		return protocolNone
+	}
+
+	if first[0] == tlsRecordTypeHandshake {
+		// Record type, then a 3.x protocol version
+		header, err := r.Peek(3)
+		if err == nil && header[1] == 0x03 && header[2] <= 0x04 {
+			return protocolTLS
+		}
+		return protocolUnknown
+	}
+
+	prefix, err := r.Peek(4)
+	if err != nil {
+		return protocolUnknown
+	}
+	if bytes.Equal(prefix, []byte("SSH-")) {
+		return protocolSSH
+	}
+	for _, method := range httpMethodPrefixes {
+		if bytes.Equal(prefix, method) {
+			return protocolHTTP
+		}
+	}
+	return protocolUnknown
+}
+
+// checkProtocol sniffs the client stream and logs a protocol_violation if it
+// does not speak the protocol rule requires. False means the tunnel must be
+// closed; discovery builds only log.
+func (p *ProxyServer) checkProtocol(entry LogEntry, rule *hostRule, client net.Conn, r *bufio.Reader) bool {
+	client.SetReadDeadline(time.Now().Add(sniffTimeout))
+	detected := detectProtocol(r)
+	client.SetReadDeadline(time.Time{})
+
+	if detected == rule.Require {
+		return true
+	}
+	p.logProtocolViolation(entry, rule, detected)
+	return p.discoveryMode
+}
+
+// logProtocolViolation logs traffic for rule that is not in its required protocol
+func (p *ProxyServer) logProtocolViolation(entry LogEntry, rule *hostRule, detected string) {
+	entry.Level = LogLevelWarning
+	entry.Event = "protocol_violation"
+	entry.Action = "closed"
+	if p.discoveryMode {
+		entry.Action = "allowed_discovery"
+	}
+	entry.Rule = rule.Entry
+	entry.DetectedProtocol = detected
+	entry.Message = "Entry requires " + rule.Require
+	p.logger.Log(entry)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "tls 1.0 record", input: "\x16\x03\x01\x02\x00\x01", want: protocolTLS},
+		{name: "tls 1.2 record", input: "\x16\x03\x03\x00\x10", want: protocolTLS},
+		{name: "handshake type bad version", input: "\x16\x09\x09\x00", want: protocolUnknown},
+		{name: "ssh banner", input: "SSH-2.0-OpenSSH_9.6\r\n", want: protocolSSH},
+		{name: "http get", input: "GET / HTTP/1.1\r\n", want: protocolHTTP},
+		{name: "http post", input: "POST /upload HTTP/1.1\r\n", want: protocolHTTP},
+		{name: "binary", input: "\x00\x01\x02\x03\x04", want: protocolUnknown},
+		{name: "short", input: "SS", want: protocolUnknown},
+		{name: "empty", input: "", want: protocolNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			if got := detectProtocol(r); got != tt.want {
+				t.Errorf("detectProtocol(%q) = %s, want %s", tt.input, got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.input {
+				t.Errorf("detectProtocol consumed input, %q left", rest)
+			}
+		})
+	}
+}
+
+// startEchoServer accepts connections on a loopback port and echoes them back
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTunnelRequiredProtocol(t *testing.T) {
+	echo := startEchoServer(t)
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	proxy := newTestProxy(t, fmt.Sprintf(`allowlist:
+  - host: 127.0.0.1
+    ports: [%d]
+    require: ssh
+`, port))
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	dest := echo.Addr().String()
+
+	// An SSH banner is passed through to the destination
+	conn, reader, status := connectThrough(t, proxyServer.Listener.Addr().String(), dest)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	conn.Write([]byte("SSH-2.0-test\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "SSH-2.0-test\r\n" {
+		t.Errorf("Expected echoed banner, got %q (%v)", line, err)
+	}
+	conn.Close()
+
+	// Anything else closes the tunnel before reaching the destination
+	conn, reader, status = connectThrough(t, proxyServer.Listener.Addr().String(), dest)
+	defer conn.Close()
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Expected tunnel to be closed, read %q", data)
+	}
+
+	entry := waitForEvent(t, &logs, "protocol_violation")
+	if entry.DetectedProtocol != protocolHTTP || entry.Action != "closed" {
+		t.Errorf("Unexpected protocol_violation entry: %+v", entry)
+	}
+	if !strings.Contains(entry.Rule, "require ssh") {
+		t.Errorf("Expected rule to mention the requirement, got %q", entry.Rule)
+	}
+	// The first tunnel closed cleanly, the second one for the violation
+	waitForEntry(t, &logs, "connection_closed", func(e LogEntry) bool {
+		return e.ClosedBy == "proxy" && e.Reason == "protocol_violation"
+	})
+}
+
+func TestHandleForwardRequiredProtocol(t *testing.T) {
+	proxy := newTestProxy(t, `allowlist:
+  - host: example.com
+    require: tls
+`)
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	entry := waitForEvent(t, &logs, "protocol_violation")
+	if entry.DetectedProtocol != protocolHTTP {
+		t.Errorf("Expected detected_protocol http, got %q", entry.DetectedProtocol)
+	}
+}
+
+func TestRequireValidation(t *testing.T) {
+	if _, err := parseRule(RuleEntry{Host: "example.com", Require: "TLS"}); err != nil {
+		t.Errorf("require: TLS should be accepted: %v", err)
+	}
+	if _, err := parseRule(RuleEntry{Host: "example.com", Require: "ftp"}); err == nil {
+		t.Error("Expected error for unsupported protocol")
+	}
+
+	originalAllowlist := allowlistYAML
+	defer func() { allowlistYAML = originalAllowlist }()
+	allowlistYAML = []byte(`allowlist:
+  - example.com
+denylist:
+  - host: evil.com
+    require: tls
+`)
+	if _, err := loadDenylist(testConfig(t)); err == nil {
+		t.Error("Expected error for a denylist entry with require")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits named in rate_limited events, X-Proxy-Rate-Limit headers and the
+// rate limit metric
+const (
+	rateLimitClient      = "client"
+	rateLimitDestination = "destination"
+)
+
+// rateLimitSweepInterval is how often a limiter looks for keys to evict
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitConfig is the rate_limits section of allowlist.yaml. Either limit
+// can be left out to disable it.
+type RateLimitConfig struct {
+	// Client limits new connections from each client address
+	Client *RateLimit `yaml:"client"`
+	// Destination limits new connections permitted by each allowlist entry
+	Destination *RateLimit `yaml:"destination"`
+}
+
+// RateLimit is a token bucket: Rate connections per second on average, with
+// up to Burst at once
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// loadRateLimiters loads the client and destination limiters; either is nil
+// when the configuration does not set it
+func loadRateLimiters(config *Config) (client, destination *rateLimiter, err error) {
+	if client, err = newRateLimiter(config.RateLimits.Client); err != nil {
+		return nil, nil, fmt.Errorf("invalid rate_limits.client in allowlist.yaml: %w", err)
+	}
+	if destination, err = newRateLimiter(config.RateLimits.Destination); err != nil {
+		return nil, nil, fmt.Errorf("invalid rate_limits.destination in allowlist.yaml: %w", err)
+	}
+	return client, destination, nil
+}
+
+// tokenBucket is the state of one key in a rateLimiter
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per key. Buckets are created on first use
+// and evicted once they have been idle long enough to refill, since a full
+// bucket behaves exactly like a new one.
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter for limit, or nil when limit is nil. A
+// missing burst defaults to one second's worth of connections.
+func newRateLimiter(limit *RateLimit) (*rateLimiter, error) {
+	if limit == nil {
+		return nil, nil
+	}
+	if limit.Rate <= 0 {
+		return nil, fmt.Errorf("rate must be positive, got %v", limit.Rate)
+	}
+	l := *limit
+	if l.Burst == 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+	if l.Burst < 0 {
+		return nil, fmt.Errorf("burst must be positive, got %d", l.Burst)
+	}
+	return &rateLimiter{
+		limit:   l,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}, nil
+}
+
+// allow takes a token from key's bucket. When none is left it returns false
+// and how long until one will be.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep evicts the buckets that would have refilled completely by now
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		refilled := bucket.tokens + now.Sub(bucket.last).Seconds()*l.limit.Rate
+		if refilled >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// len returns the number of keys being tracked
+func (l *rateLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// rateLimited is a connection refused by one of the rate limits
+type rateLimited struct {
+	Limit      string // rateLimitClient or rateLimitDestination
+	Key        string
+	RetryAfter time.Duration
+	limit      RateLimit
+}
+
+// limitClient applies the client limit, keyed by the client's IP address.
+// It runs before a request is authenticated or checked against the
+// allowlist, so refused and unauthenticated requests count too. A refused
+// request is logged as a rate_limited connection_attempt and a rate_limited
+// event built on entry, and the limit returned.
+func (p *ProxyServer) limitClient(entry LogEntry) *rateLimited {
+	if p.clientLimiter == nil {
+		return nil
+	}
+	key := entry.ClientAddr
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	ok, wait := p.clientLimiter.allow(key)
+	if ok {
+		return nil
+	}
+
+	limited := &rateLimited{Limit: rateLimitClient, Key: key, RetryAfter: wait, limit: p.clientLimiter.limit}
+	d := Decision{Destination: entry.Destination}
+	limited.refuse(&d)
+	entry.Level = LogLevelWarning
+	entry.Event = "connection_attempt"
+	entry.Extra = limited.extra()
+	d.apply(&entry)
+	p.logAttempt(entry)
+	p.logRateLimited(entry, limited)
+	return limited
+}
+
+// logRateLimited follows the connection_attempt entry of a connection
+// refused by l with a rate_limited event naming the limit, and counts it
+func (p *ProxyServer) logRateLimited(entry LogEntry, l *rateLimited) {
+	entry.Level = LogLevelWarning
+	entry.Event = "rate_limited"
+	entry.Action = ""
+	entry.Reason = l.Limit
+	entry.Extra = l.extra()
+	p.logger.Log(entry)
+	p.metrics.rateLimited(l.Limit)
+}
+
+// checkDestinationLimit applies the destination limit to an allowed
+// decision, keyed by its allowlist entry (or the destination host when no
+// entry matched). It returns the limit if it refuses the connection.
+func (p *ProxyServer) checkDestinationLimit(d Decision) *rateLimited {
+	if p.destinationLimiter == nil {
+		return nil
+	}
+	key := d.Rule
+	if key == "" {
+		key, _, _ = net.SplitHostPort(d.Destination)
+	}
+	if ok, wait := p.destinationLimiter.allow(key); !ok {
+		return &rateLimited{Limit: rateLimitDestination, Key: key, RetryAfter: wait, limit: p.destinationLimiter.limit}
+	}
+	return nil
+}
+
+// refuse turns an allowed decision into a refusal by the rate limit; the
+// rule that allowed the destination is kept
+func (l *rateLimited) refuse(d *Decision) {
+	d.Allowed = false
+	d.Action = "rate_limited"
+	d.Reason = reasonClientRateLimit
+	if l.Limit == rateLimitDestination {
+		d.Reason = reasonDestRateLimit
+	}
+	d.limited = l
+}
+
+// extra describes the bucket that refused the connection for its log entry
+func (l *rateLimited) extra() map[string]interface{} {
+	return map[string]interface{}{
+		"key":         l.Key,
+		"rate":        l.limit.Rate,
+		"burst":       l.limit.Burst,
+		"retry_after": l.RetryAfter.String(),
+	}
+}
+
+// tooManyRequests answers an HTTP client refused by a rate limit
+func tooManyRequests(w http.ResponseWriter, limited *rateLimited) {
+	seconds := int(math.Ceil(limited.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("X-Proxy-Rate-Limit", limited.Limit)
+	http.Error(w, "Too Many Requests: "+limited.Limit+" rate limit exceeded", http.StatusTooManyRequests)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source for rate limiters
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(t *testing.T, rate float64, burst int) (*rateLimiter, *fakeClock) {
+	t.Helper()
+	limiter, err := newRateLimiter(&RateLimit{Rate: rate, Burst: burst})
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	limiter.now = clock.now
+	return limiter, clock
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	limiter, clock := newTestLimiter(t, 2, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("a"); !ok {
+			t.Fatalf("Request %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := limiter.allow("a")
+	if ok {
+		t.Fatal("Request over the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for a token, got %s", wait)
+	}
+
+	// Other keys have their own buckets
+	if ok, _ := limiter.allow("b"); !ok {
+		t.Error("A different key should not be limited")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := limiter.allow("a"); !ok {
+		t.Error("Expected a token after refilling")
+	}
+	if ok, _ := limiter.allow("a"); ok {
+		t.Error("Expected only one token after 500ms")
+	}
+}
+
+func TestRateLimiterEvictsIdleKeys(t *testing.T) {
+	limiter, clock := newTestLimiter(t, 1, 10)
+
+	limiter.allow("idle")
+	clock.advance(rateLimitSweepInterval - 5*time.Second)
+	for i := 0; i < 10; i++ {
+		limiter.allow("busy")
+	}
+	if n := limiter.len(); n != 2 {
+		t.Fatalf("Expected 2 keys, got %d", n)
+	}
+
+	// At the next sweep "idle" has refilled but "busy" has not
+	clock.advance(5 * time.Second)
+	limiter.allow("new")
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Error("Idle key should have been evicted")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Error("Busy key should have been kept")
+	}
+	if n := limiter.len(); n != 2 {
+		t.Errorf("Expected 2 keys after the sweep, got %d", n)
+	}
+}
+
+func TestLoadRateLimiters(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com\n")
+	if proxy.clientLimiter != nil || proxy.destinationLimiter != nil {
+		t.Error("Rate limits should be off unless configured")
+	}
+
+	proxy = newTestProxy(t, "rate_limits:\n  client: {rate: 2.5}\n  destination: {rate: 10, burst: 50}\nallowlist:\n  - example.com\n")
+	if proxy.clientLimiter == nil || proxy.clientLimiter.limit != (RateLimit{Rate: 2.5, Burst: 3}) {
+		t.Errorf("Unexpected client limit %+v", proxy.clientLimiter)
+	}
+	if proxy.destinationLimiter == nil || proxy.destinationLimiter.limit != (RateLimit{Rate: 10, Burst: 50}) {
+		t.Errorf("Unexpected destination limit %+v", proxy.destinationLimiter)
+	}
+
+	original := allowlistYAML
+	defer func() { allowlistYAML = original }()
+	for _, config := range []string{
+		"rate_limits:\n  client: {burst: 5}\n",
+		"rate_limits:\n  destination: {rate: -1}\n",
+		"rate_limits:\n  client: {rate: 1, burst: -2}\n",
+	} {
+		allowlistYAML = []byte(config)
+		if _, err := NewProxyServer("localhost:0", NewLogger(io.Discard)); err == nil {
+			t.Errorf("Expected an error for config:\n%s", config)
+		}
+	}
+}
+
+func TestHandleConnectRateLimited(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit string
+		dests []string // the last one is refused
+	}{
+		// Hosts matching one entry share its destination bucket
+		{"destination", "destination: {rate: 0.001, burst: 2}", []string{"a.example.com:443", "b.example.com:443", "c.example.com:443"}},
+		{"client", "client: {rate: 0.001, burst: 1}", []string{"a.example.com:443", "example.org:443"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			proxy := newTestProxy(t, "rate_limits:\n  "+tt.limit+"\nallowlist:\n  - '*.example.com'\n  - example.org\n")
+			proxy.logger = NewLogger(&buf)
+			// Every request is refused after the rate check by a blocked address
+			proxy.resolver = staticResolver{
+				"a.example.com": {"127.0.0.1"},
+				"b.example.com": {"127.0.0.1"},
+				"c.example.com": {"127.0.0.1"},
+				"example.org":   {"127.0.0.1"},
+			}
+
+			var w *httptest.ResponseRecorder
+			for _, dest := range tt.dests {
+				req := httptest.NewRequest("CONNECT", "http://"+dest, nil)
+				req.Host = dest
+				req.RemoteAddr = "127.0.0.1:40000"
+				w = httptest.NewRecorder()
+				proxy.handleConnect(w, req)
+			}
+
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+			}
+			if w.Header().Get("Retry-After") == "" || w.Header().Get("X-Proxy-Rate-Limit") != tt.name {
+				t.Errorf("Unexpected headers %v", w.Header())
+			}
+
+			// Every connection has one attempt, and the refused one
+			// is not also logged as allowed or shadow-checked
+			var attempts, events []LogEntry
+			for _, entry := range logEntries(t, &buf) {
+				switch {
+				case entry.Event == "connection_attempt" && entry.Action != "blocked_resolved_ip":
+					attempts = append(attempts, entry)
+				case entry.Event == "rate_limited":
+					events = append(events, entry)
+				}
+			}
+			if len(attempts) != len(tt.dests) {
+				t.Fatalf("Expected %d attempts, got %+v", len(tt.dests), attempts)
+			}
+			limited := attempts[len(attempts)-1]
+			if limited.Action != "rate_limited" || limited.Reason != tt.name+"_rate_limit" || limited.Level != LogLevelWarning || limited.Destination != tt.dests[len(tt.dests)-1] {
+				t.Errorf("Unexpected rate_limited attempt %+v", limited)
+			}
+			// The client limit is applied before the allowlist is consulted
+			if (tt.name == rateLimitDestination) != (limited.Rule != "" && limited.RuleIndex != nil) {
+				t.Errorf("Expected only the destination limit to keep the allowing rule, got %+v", limited)
+			}
+			if tt.name == rateLimitDestination && limited.Extra["key"] != "*.example.com" {
+				t.Errorf("Expected the destination limit keyed by rule, got %v", limited.Extra["key"])
+			}
+			if tt.name == rateLimitClient && limited.Extra["key"] != "127.0.0.1" {
+				t.Errorf("Expected the client limit keyed by address, got %v", limited.Extra["key"])
+			}
+			if len(events) != 1 {
+				t.Fatalf("Expected one rate_limited event, got %+v", events)
+			}
+			if event := events[0]; event.Reason != tt.name || event.Level != LogLevelWarning || event.ConnectionID != limited.ConnectionID || event.Rule != limited.Rule || event.Extra["key"] != limited.Extra["key"] {
+				t.Errorf("Unexpected rate_limited event %+v", event)
+			}
+
+			var metrics strings.Builder
+			proxy.metrics.WriteTo(&metrics)
+			if !strings.Contains(metrics.String(), `restricted_proxy_rate_limited_total{limit="`+tt.name+`"} 1`) {
+				t.Errorf("Expected the rate limit to be counted:\n%s", metrics.String())
+			}
+			if !strings.Contains(metrics.String(), `restricted_proxy_connection_attempts_total{action="rate_limited",protocol="connect",rule="`+limited.Rule+`"} 1`) {
+				t.Errorf("Expected the refused attempt to be counted as rate_limited:\n%s", metrics.String())
+			}
+		})
+	}
+}
+
+func TestClientRateLimitSkipsProcessLookup(t *testing.T) {
+	proxy := newTestProxy(t, "rate_limits:\n  client: {rate: 0.001, burst: 1}\nallowlist:\n  - example.com:443\n")
+	proxy.logger = NewLogger(&bytes.Buffer{})
+
+	var processes []*clientProcess
+	for i := 0; i < 2; i++ {
+		process := newClientProcess("127.0.0.1:40000", "127.0.0.1:8080")
+		processes = append(processes, process)
+		req := httptest.NewRequest("CONNECT", "http://blocked.example:443", nil)
+		req.Host = "blocked.example:443"
+		req = req.WithContext(context.WithValue(req.Context(), clientProcessKey{}, process))
+		proxy.handleConnect(httptest.NewRecorder(), req)
+	}
+
+	// The lookup fails for the made-up address, but only the admitted
+	// request tries it
+	if admitted := processes[0]; admitted.info == nil && admitted.err == nil {
+		t.Error("Expected the admitted request's process to be looked up")
+	}
+	if refused := processes[1]; refused.info != nil || refused.err != nil {
+		t.Errorf("Expected no lookup for the rate limited request, got %+v, %v", refused.info, refused.err)
+	}
+}
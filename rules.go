@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleEntry is one item of the allowlist or denylist section. It is written either as a
+// plain string ("api.example.com:443") or as a mapping that lists several
+// ports and ranges:
+//
+//   - host: api.example.com
+//     ports: [443, 8443-8450]
+type RuleEntry struct {
+	Host  string   `yaml:"host"`
+	Ports []string `yaml:"ports,omitempty"`
+	// Require names the protocol tunneled traffic must speak: tls, ssh or http
+	Require string `yaml:"require,omitempty"`
+	// Mode is enforce (the default) or report, which only logs what the
+	// entry would change; see shadowPolicy
+	Mode string `yaml:"mode,omitempty"`
+	// IdleTimeout and MaxLifetime override the timeouts section for tunnels
+	// the entry permits
+	IdleTimeout *time.Duration `yaml:"idle_timeout,omitempty"`
+	MaxLifetime *time.Duration `yaml:"max_lifetime,omitempty"`
+	// Bandwidth and Quota limit the traffic of tunnels the entry permits
+	Bandwidth *BandwidthConfig `yaml:"bandwidth,omitempty"`
+	Quota     *QuotaConfig     `yaml:"quota,omitempty"`
+	// Index is the position of the entry in its section, set by loadConfig
+	Index int `yaml:"-"`
+}
+
+// UnmarshalYAML accepts both the plain string and the mapping form
+func (e *RuleEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = RuleEntry{Host: node.Value}
+		return nil
+	}
+
+	type plain RuleEntry
+	var entry plain
+	if err := node.Decode(&entry); err != nil {
+		return err
+	}
+	*e = RuleEntry(entry)
+	return nil
+}
+
+// String renders the entry for logs and error messages
+func (e RuleEntry) String() string {
+	s := e.Host
+	if len(e.Ports) > 0 {
+		s += fmt.Sprintf(" ports [%s]", strings.Join(e.Ports, ", "))
+	}
+	if e.Require != "" {
+		s += " require " + e.Require
+	}
+	if e.Mode != "" {
+		s += " mode " + e.Mode
+	}
+	if e.IdleTimeout != nil {
+		s += " idle_timeout " + e.IdleTimeout.String()
+	}
+	if e.MaxLifetime != nil {
+		s += " max_lifetime " + e.MaxLifetime.String()
+	}
+	if b := e.Bandwidth; b != nil {
+		s += fmt.Sprintf(" bandwidth [upload %s, download %s]", b.Upload, b.Download)
+	}
+	if q := e.Quota; q != nil {
+		s += fmt.Sprintf(" quota [upload %s, download %s", q.Upload, q.Download)
+		if q.Window > 0 {
+			s += ", window " + q.Window.String()
+		}
+		s += "]"
+	}
+	return s
+}
+
+// supportedProtocols are the values accepted by RuleEntry.Require
+var supportedProtocols = map[string]bool{
+	protocolTLS:  true,
+	protocolSSH:  true,
+	protocolHTTP: true,
+}
+
+// portRange is an inclusive range of TCP ports
+type portRange struct {
+	lo, hi int
+}
+
+// portSet is the set of ports an entry permits; an empty set permits any port
+type portSet []portRange
+
+// parsePortSet parses port specs such as "443" and "8443-8450", rejecting
+// ranges that are reversed or overlap one another
+func parsePortSet(specs []string) (portSet, error) {
+	var set portSet
+	for _, spec := range specs {
+		r, err := parsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range set {
+			if r.lo <= other.hi && other.lo <= r.hi {
+				return nil, fmt.Errorf("port %q overlaps %s", spec, other)
+			}
+		}
+		set = append(set, r)
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i].lo < set[j].lo })
+	return set, nil
+}
+
+// parsePortRange parses a single port or an inclusive lo-hi range
+func parsePortRange(spec string) (portRange, error) {
+	spec = strings.TrimSpace(spec)
+	loStr, hiStr := spec, spec
+	if i := strings.IndexByte(spec, '-'); i >= 0 {
+		loStr, hiStr = spec[:i], spec[i+1:]
+	}
+
+	lo, errLo := parsePort(loStr)
+	hi, errHi := parsePort(hiStr)
+	if errLo != nil || errHi != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", spec)
+	}
+	if lo > hi {
+		return portRange{}, fmt.Errorf("invalid port range %q: start is after end", spec)
+	}
+	return portRange{lo: lo, hi: hi}, nil
+}
+
+// parsePort parses a decimal TCP port in the range 1-65535
+func parsePort(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return n, nil
+}
+
+// String renders the range as it would be written in allowlist.yaml
+func (r portRange) String() string {
+	if r.lo == r.hi {
+		return strconv.Itoa(r.lo)
+	}
+	return fmt.Sprintf("%d-%d", r.lo, r.hi)
+}
+
+// String renders the set as a comma-separated list, or "" for any port
+func (ps portSet) String() string {
+	parts := make([]string, len(ps))
+	for i, r := range ps {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// contains reports whether port is permitted by the set
+func (ps portSet) contains(port string) bool {
+	if len(ps) == 0 {
+		return true
+	}
+	n, err := parsePort(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range ps {
+		if n >= r.lo && n <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKind describes how an entry's host is compared to a destination
+type matchKind int
+
+const (
+	// matchExact matches the host exactly ("example.com")
+	matchExact matchKind = iota
+	// matchSubdomains matches any name below the domain but not the apex ("*.example.com")
+	matchSubdomains
+	// matchDomain matches the apex and any name below it (".example.com")
+	matchDomain
+	// matchCIDR matches IP literals inside a network ("10.20.0.0/16")
+	matchCIDR
+)
+
+// hostRule is a single parsed allowlist or denylist entry
+type hostRule struct {
+	Entry string     // entry as written in allowlist.yaml
+	Host  string     // normalized host, without any wildcard prefix
+	Kind  matchKind  // how Host is compared
+	Net   *net.IPNet // network for matchCIDR rules
+	Ports portSet    // permitted ports, empty for any port
+	// Require is the protocol tunneled traffic must speak, or "" for any
+	Require string
+	// IdleTimeout and MaxLifetime override the configured tunnel timeouts
+	// when set
+	IdleTimeout *time.Duration
+	MaxLifetime *time.Duration
+	// Traffic holds the entry's bandwidth caps and quotas, or nil for none
+	Traffic *trafficPolicy
+	// Index is the position of the entry in its section of allowlist.yaml
+	Index int
+}
+
+// parseRule parses an RuleEntry in either form. A mapping entry takes its
+// ports from the ports list, so its host must not carry a port of its own.
+func parseRule(entry RuleEntry) (hostRule, error) {
+	rule, err := parseHostEntry(entry.Host)
+	if err != nil {
+		return rule, err
+	}
+	rule.Entry = entry.String()
+	rule.Index = entry.Index
+
+	if len(entry.Ports) > 0 {
+		if len(rule.Ports) > 0 {
+			return rule, fmt.Errorf("invalid entry %q: host has a port and a ports list", rule.Entry)
+		}
+		if rule.Ports, err = parsePortSet(entry.Ports); err != nil {
+			return rule, fmt.Errorf("invalid entry %q: %w", rule.Entry, err)
+		}
+	}
+
+	if entry.Require != "" {
+		rule.Require = strings.ToLower(entry.Require)
+		if !supportedProtocols[rule.Require] {
+			return rule, fmt.Errorf("invalid entry %q: unsupported protocol %q in require", rule.Entry, entry.Require)
+		}
+	}
+
+	if _, err := (tunnelTimeouts{}).override(entry.IdleTimeout, entry.MaxLifetime); err != nil {
+		return rule, fmt.Errorf("invalid entry %q: %w", rule.Entry, err)
+	}
+	rule.IdleTimeout, rule.MaxLifetime = entry.IdleTimeout, entry.MaxLifetime
+
+	if rule.Traffic, err = newTrafficPolicy(entry.Bandwidth, entry.Quota); err != nil {
+		return rule, fmt.Errorf("invalid entry %q: %w", rule.Entry, err)
+	}
+
+	if entry.Mode != "" && entry.Mode != ruleModeEnforce && entry.Mode != ruleModeReport {
+		return rule, fmt.Errorf("invalid entry %q: mode must be %s or %s", rule.Entry, ruleModeEnforce, ruleModeReport)
+	}
+
+	return rule, nil
+}
+
+// parseHostEntry parses an entry of the form host, host:port,
+// *.domain[:port], .domain[:port], an IP literal or a CIDR network. IPv6
+// literals and networks must be bracketed when a port is given, e.g.
+// "[2001:db8::/32]:443".
+//
+// Wildcards are only accepted as a whole leading label and must leave at least
+// two labels behind, so "*.com", "*example.com" and "a.*.example.com" are all
+// rejected rather than guessed at. Networks must be written with their host
+// bits cleared for the same reason.
+func parseHostEntry(entry string) (hostRule, error) {
+	rule := hostRule{Entry: entry}
+
+	hostPart, port, err := splitEntry(strings.TrimSpace(entry))
+	if err != nil {
+		return rule, fmt.Errorf("invalid entry %q: %w", entry, err)
+	}
+	if port != "" {
+		n, err := parsePort(port)
+		if err != nil {
+			return rule, fmt.Errorf("invalid port in entry %q", entry)
+		}
+		rule.Ports = portSet{{lo: n, hi: n}}
+	}
+
+	if strings.Contains(hostPart, "/") {
+		ip, ipNet, err := net.ParseCIDR(hostPart)
+		if err != nil {
+			return rule, fmt.Errorf("invalid entry %q: %w", entry, err)
+		}
+		if !ip.Equal(ipNet.IP) {
+			return rule, fmt.Errorf("invalid entry %q: network has host bits set (did you mean %s?)", entry, ipNet)
+		}
+		rule.Kind, rule.Net, rule.Host = matchCIDR, ipNet, ipNet.String()
+		return rule, nil
+	}
+
+	if ip := net.ParseIP(hostPart); ip != nil {
+		rule.Host = ip.String()
+		return rule, nil
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(hostPart), ".")
+	switch {
+	case strings.HasPrefix(host, "*."):
+		rule.Kind = matchSubdomains
+		host = host[2:]
+	case strings.HasPrefix(host, "."):
+		rule.Kind = matchDomain
+		host = host[1:]
+	}
+
+	if err := validateHostname(host); err != nil {
+		return rule, fmt.Errorf("invalid entry %q: %w", entry, err)
+	}
+	if rule.Kind != matchExact && !strings.Contains(host, ".") {
+		return rule, fmt.Errorf("invalid entry %q: wildcard must cover at least two labels", entry)
+	}
+
+	rule.Host = host
+	return rule, nil
+}
+
+// splitEntry separates an entry into its host and optional port. A bracketed
+// host may carry a port; an unbracketed host with more than one colon is a
+// bare IPv6 literal or network. A colon must be followed by a port.
+func splitEntry(entry string) (host, port string, err error) {
+	switch {
+	case entry == "":
+		return "", "", fmt.Errorf("empty entry")
+	case strings.HasPrefix(entry, "["):
+		end := strings.IndexByte(entry, ']')
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ']'")
+		}
+		rest := entry[end+1:]
+		host = entry[1:end]
+		if !strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("brackets are only valid around IPv6 addresses")
+		}
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("unexpected %q after ']'", rest)
+		}
+		port = rest[1:]
+	case strings.Count(entry, ":") == 1:
+		if host, port, err = net.SplitHostPort(entry); err != nil {
+			return "", "", err
+		}
+	default:
+		return entry, "", nil
+	}
+
+	// A trailing colon would otherwise read as "any port"
+	if port == "" {
+		return "", "", fmt.Errorf("empty port")
+	}
+	return host, port, nil
+}
+
+// validateHostname checks that host is a sequence of non-empty DNS labels
+// without wildcards
+func validateHostname(host string) error {
+	if host == "" {
+		return fmt.Errorf("empty host")
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return fmt.Errorf("empty label in host %q", host)
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			case c == '*':
+				return fmt.Errorf("wildcard is only allowed as the whole first label")
+			default:
+				return fmt.Errorf("invalid character %q in host %q", c, host)
+			}
+		}
+	}
+	return nil
+}
+
+// ruleSet matches destinations against a list of hostRules.
+//
+// Exact hosts are kept in one map and wildcard domains in another, so a lookup
+// costs one map access per label of the destination host regardless of how
+// many entries are configured. IP literals are looked up in canonical form and
+// then checked against the networks, narrowest first.
+type ruleSet struct {
+	rules    []hostRule
+	exact    map[string][]int // host -> indexes of exact and ".domain" rules
+	suffixes map[string][]int // domain -> indexes of "*.domain" and ".domain" rules
+	networks []int            // indexes of CIDR rules, longest prefix first
+}
+
+// compileRules parses entries into a ruleSet, rejecting malformed entries and
+// entries that duplicate one another
+func compileRules(entries []RuleEntry) (*ruleSet, error) {
+	set := &ruleSet{
+		exact:    make(map[string][]int),
+		suffixes: make(map[string][]int),
+	}
+	seen := make(map[string]string)
+
+	for _, entry := range entries {
+		rule, err := parseRule(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		key := fmt.Sprintf("%d|%s|%s", rule.Kind, rule.Host, rule.Ports)
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("entry %q duplicates %q", rule.Entry, prev)
+		}
+		seen[key] = rule.Entry
+
+		idx := len(set.rules)
+		set.rules = append(set.rules, rule)
+		if rule.Kind == matchCIDR {
+			set.networks = append(set.networks, idx)
+			continue
+		}
+		if rule.Kind != matchSubdomains {
+			set.exact[rule.Host] = append(set.exact[rule.Host], idx)
+		}
+		if rule.Kind != matchExact {
+			set.suffixes[rule.Host] = append(set.suffixes[rule.Host], idx)
+		}
+	}
+
+	sort.SliceStable(set.networks, func(i, j int) bool {
+		a, _ := set.rules[set.networks[i]].Net.Mask.Size()
+		b, _ := set.rules[set.networks[j]].Net.Mask.Size()
+		return a > b
+	})
+
+	return set, nil
+}
+
+// Len returns the number of rules in the set
+func (s *ruleSet) Len() int {
+	return len(s.rules)
+}
+
+// anyPort can be passed to match to find a rule for the host whatever its ports
+const anyPort = "*"
+
+// match returns the rule permitting host on port, if any. Exact entries are
+// preferred over wildcards, and longer wildcard domains over shorter ones.
+// host is expected without brackets, as returned by net.SplitHostPort.
+func (s *ruleSet) match(host, port string) (*hostRule, bool) {
+	if ip := net.ParseIP(host); ip != nil {
+		return s.matchIP(ip, port)
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if rule, ok := s.firstWithPort(s.exact[host], port); ok {
+		return rule, true
+	}
+
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		host = host[i+1:]
+		if rule, ok := s.firstWithPort(s.suffixes[host], port); ok {
+			return rule, true
+		}
+		i = strings.IndexByte(host, '.')
+	}
+
+	return nil, false
+}
+
+// matchIP returns the rule permitting ip on port, if any. Hostname and
+// wildcard entries never match an IP literal.
+func (s *ruleSet) matchIP(ip net.IP, port string) (*hostRule, bool) {
+	if rule, ok := s.firstWithPort(s.exact[ip.String()], port); ok {
+		return rule, true
+	}
+
+	for _, idx := range s.networks {
+		rule := &s.rules[idx]
+		if rule.Net.Contains(ip) && (port == anyPort || rule.Ports.contains(port)) {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
+// firstWithPort returns the first of the indexed rules that accepts port
+func (s *ruleSet) firstWithPort(indexes []int, port string) (*hostRule, bool) {
+	for _, idx := range indexes {
+		rule := &s.rules[idx]
+		if port == anyPort || rule.Ports.contains(port) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
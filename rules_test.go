@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stringEntries builds allowlist entries in the plain string form
+func stringEntries(hosts ...string) []RuleEntry {
+	entries := make([]RuleEntry, len(hosts))
+	for i, host := range hosts {
+		entries[i] = RuleEntry{Host: host, Index: i}
+	}
+	return entries
+}
+
+func TestParseHostEntry(t *testing.T) {
+	tests := []struct {
+		entry   string
+		host    string
+		kind    matchKind
+		port    string
+		wantErr bool
+	}{
+		{entry: "example.com", host: "example.com", kind: matchExact},
+		{entry: "Example.COM:443", host: "example.com", kind: matchExact, port: "443"},
+		{entry: "example.com.", host: "example.com", kind: matchExact},
+		{entry: "*.githubusercontent.com:443", host: "githubusercontent.com", kind: matchSubdomains, port: "443"},
+		{entry: ".example.com", host: "example.com", kind: matchDomain},
+		{entry: ".example.com:8443", host: "example.com", kind: matchDomain, port: "8443"},
+		{entry: "", wantErr: true},
+		{entry: "*", wantErr: true},
+		{entry: "*.com", wantErr: true},
+		{entry: ".com", wantErr: true},
+		{entry: "*example.com", wantErr: true},
+		{entry: "a.*.example.com", wantErr: true},
+		{entry: "*.*.example.com", wantErr: true},
+		{entry: "..example.com", wantErr: true},
+		{entry: "example..com", wantErr: true},
+		{entry: "example.com:0", wantErr: true},
+		{entry: "example.com:https", wantErr: true},
+		{entry: "example.com:70000", wantErr: true},
+		{entry: "exa mple.com", wantErr: true},
+		{entry: "api.example.com:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			rule, err := parseHostEntry(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHostEntry(%q) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if rule.Host != tt.host || rule.Kind != tt.kind || rule.Ports.String() != tt.port {
+				t.Errorf("parseHostEntry(%q) = {%s %d %s}, want {%s %d %s}",
+					tt.entry, rule.Host, rule.Kind, rule.Ports, tt.host, tt.kind, tt.port)
+			}
+		})
+	}
+}
+
+func TestCompileRulesRejectsDuplicates(t *testing.T) {
+	if _, err := compileRules(stringEntries("example.com:443", "EXAMPLE.com:443")); err == nil {
+		t.Error("Expected error for duplicate entries")
+	}
+	if _, err := compileRules(stringEntries("*.example.com", "*.example.com")); err == nil {
+		t.Error("Expected error for duplicate wildcard entries")
+	}
+	if _, err := compileRules(stringEntries("example.com", "example.com:443", "*.example.com", ".example.com")); err != nil {
+		t.Errorf("Distinct entries should compile: %v", err)
+	}
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	set, err := compileRules(stringEntries(
+		"api.example.com:443",
+		"*.githubusercontent.com:443",
+		".example.org",
+		"*.s3.amazonaws.com",
+	))
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	tests := []struct {
+		host    string
+		port    string
+		allowed bool
+		entry   string
+	}{
+		{host: "api.example.com", port: "443", allowed: true, entry: "api.example.com:443"},
+		{host: "api.example.com", port: "80", allowed: false},
+		{host: "example.com", port: "443", allowed: false},
+		{host: "raw.githubusercontent.com", port: "443", allowed: true, entry: "*.githubusercontent.com:443"},
+		{host: "a.b.githubusercontent.com", port: "443", allowed: true, entry: "*.githubusercontent.com:443"},
+		{host: "githubusercontent.com", port: "443", allowed: false},
+		{host: "raw.githubusercontent.com", port: "80", allowed: false},
+		{host: "evilgithubusercontent.com", port: "443", allowed: false},
+		{host: "example.org", port: "8080", allowed: true, entry: ".example.org"},
+		{host: "www.example.org", port: "443", allowed: true, entry: ".example.org"},
+		{host: "WWW.Example.Org.", port: "443", allowed: true, entry: ".example.org"},
+		{host: "bucket.s3.amazonaws.com", port: "443", allowed: true, entry: "*.s3.amazonaws.com"},
+		{host: "s3.amazonaws.com", port: "443", allowed: false},
+		{host: "amazonaws.com", port: "443", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+":"+tt.port, func(t *testing.T) {
+			rule, ok := set.match(tt.host, tt.port)
+			if ok != tt.allowed {
+				t.Fatalf("match(%s, %s) = %v, want %v", tt.host, tt.port, ok, tt.allowed)
+			}
+			if ok && rule.Entry != tt.entry {
+				t.Errorf("match(%s, %s) matched %q, want %q", tt.host, tt.port, rule.Entry, tt.entry)
+			}
+		})
+	}
+}
+
+func TestRuleSetMatchPrefersMostSpecific(t *testing.T) {
+	set, err := compileRules(stringEntries(".example.com", "*.api.example.com", "v1.api.example.com"))
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	for host, want := range map[string]string{
+		"v1.api.example.com": "v1.api.example.com",
+		"v2.api.example.com": "*.api.example.com",
+		"api.example.com":    ".example.com",
+	} {
+		rule, ok := set.match(host, "443")
+		if !ok || rule.Entry != want {
+			t.Errorf("match(%s) = %v, want %q", host, rule, want)
+		}
+	}
+}
+
+func BenchmarkRuleSetMatchLarge(b *testing.B) {
+	entries := make([]RuleEntry, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		entries = append(entries, RuleEntry{Host: fmt.Sprintf("*.bucket%d.s3.amazonaws.com:443", i)})
+	}
+	set, err := compileRules(entries)
+	if err != nil {
+		b.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.match("object.bucket4999.s3.amazonaws.com", "443")
+	}
+}
+
+func TestParseHostEntryIPs(t *testing.T) {
+	tests := []struct {
+		entry   string
+		host    string
+		kind    matchKind
+		port    string
+		wantErr bool
+	}{
+		{entry: "10.0.0.5", host: "10.0.0.5", kind: matchExact},
+		{entry: "10.0.0.5:443", host: "10.0.0.5", kind: matchExact, port: "443"},
+		{entry: "10.20.0.0/16", host: "10.20.0.0/16", kind: matchCIDR},
+		{entry: "10.20.0.0/16:443", host: "10.20.0.0/16", kind: matchCIDR, port: "443"},
+		{entry: "2001:db8::1", host: "2001:db8::1", kind: matchExact},
+		{entry: "[2001:DB8::1]:443", host: "2001:db8::1", kind: matchExact, port: "443"},
+		{entry: "[::1]", host: "::1", kind: matchExact},
+		{entry: "2001:db8::/32", host: "2001:db8::/32", kind: matchCIDR},
+		{entry: "[2001:db8::/32]:443", host: "2001:db8::/32", kind: matchCIDR, port: "443"},
+		{entry: "10.20.1.0/16", wantErr: true},
+		{entry: "10.20.0.0/33", wantErr: true},
+		{entry: "[2001:db8::/32]443", wantErr: true},
+		{entry: "[2001:db8::/32:443", wantErr: true},
+		{entry: "[example.com]:443", wantErr: true},
+		{entry: "*.10.0.0.0/8", wantErr: true},
+		{entry: "[2001:db8::1]:", wantErr: true},
+		{entry: "10.0.0.0/8:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			rule, err := parseHostEntry(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHostEntry(%q) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if rule.Host != tt.host || rule.Kind != tt.kind || rule.Ports.String() != tt.port {
+				t.Errorf("parseHostEntry(%q) = {%s %d %s}, want {%s %d %s}",
+					tt.entry, rule.Host, rule.Kind, rule.Ports, tt.host, tt.kind, tt.port)
+			}
+		})
+	}
+}
+
+func TestRuleSetMatchIPs(t *testing.T) {
+	set, err := compileRules(stringEntries(
+		"10.0.0.0/8:443",
+		"10.20.0.0/16",
+		"192.168.1.10:22",
+		"[2001:db8::/32]:443",
+		"::1",
+		"ip.example.com",
+	))
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	tests := []struct {
+		hostPort string
+		allowed  bool
+		entry    string
+	}{
+		{hostPort: "10.0.0.5:443", allowed: true, entry: "10.0.0.0/8:443"},
+		{hostPort: "10.0.0.5:80", allowed: false},
+		{hostPort: "10.20.3.4:80", allowed: true, entry: "10.20.0.0/16"},
+		{hostPort: "10.20.3.4:443", allowed: true, entry: "10.20.0.0/16"},
+		{hostPort: "11.0.0.1:443", allowed: false},
+		{hostPort: "192.168.1.10:22", allowed: true, entry: "192.168.1.10:22"},
+		{hostPort: "192.168.1.10:443", allowed: false},
+		{hostPort: "[2001:db8:1::5]:443", allowed: true, entry: "[2001:db8::/32]:443"},
+		{hostPort: "[2001:DB8::5]:443", allowed: true, entry: "[2001:db8::/32]:443"},
+		{hostPort: "[2001:db9::5]:443", allowed: false},
+		{hostPort: "[::1]:8080", allowed: true, entry: "::1"},
+		{hostPort: "[0:0:0:0:0:0:0:1]:8080", allowed: true, entry: "::1"},
+		{hostPort: "[::ffff:10.20.0.1]:80", allowed: true, entry: "10.20.0.0/16"},
+		{hostPort: "ip.example.com:443", allowed: true, entry: "ip.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostPort, func(t *testing.T) {
+			host, port, err := net.SplitHostPort(tt.hostPort)
+			if err != nil {
+				t.Fatalf("SplitHostPort(%s): %v", tt.hostPort, err)
+			}
+			rule, ok := set.match(host, port)
+			if ok != tt.allowed {
+				t.Fatalf("match(%s) = %v, want %v", tt.hostPort, ok, tt.allowed)
+			}
+			if ok && rule.Entry != tt.entry {
+				t.Errorf("match(%s) matched %q, want %q", tt.hostPort, rule.Entry, tt.entry)
+			}
+		})
+	}
+}
+
+func TestRuleEntryUnmarshal(t *testing.T) {
+	yamlContent := `allowlist:
+  - example.com:443
+  - host: api.example.com
+    ports: [443, 8443-8450]
+  - host: "*.internal.example.com"
+`
+
+	var config Config
+	if err := yaml.Unmarshal([]byte(yamlContent), &config); err != nil {
+		t.Fatalf("Failed to unmarshal YAML: %v", err)
+	}
+
+	want := []RuleEntry{
+		{Host: "example.com:443"},
+		{Host: "api.example.com", Ports: []string{"443", "8443-8450"}},
+		{Host: "*.internal.example.com"},
+	}
+	if !reflect.DeepEqual(config.Allowlist, want) {
+		t.Errorf("Allowlist = %#v, want %#v", config.Allowlist, want)
+	}
+}
+
+func TestParseRulePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   RuleEntry
+		ports   string
+		wantErr bool
+	}{
+		{name: "single port", entry: RuleEntry{Host: "a.example.com", Ports: []string{"443"}}, ports: "443"},
+		{name: "list and range", entry: RuleEntry{Host: "a.example.com", Ports: []string{"9443", "443", "8443-8450"}}, ports: "443,8443-8450,9443"},
+		{name: "single-port range", entry: RuleEntry{Host: "a.example.com", Ports: []string{"22-22"}}, ports: "22"},
+		{name: "cidr", entry: RuleEntry{Host: "10.0.0.0/8", Ports: []string{"443", "8443"}}, ports: "443,8443"},
+		{name: "no ports", entry: RuleEntry{Host: "a.example.com"}, ports: ""},
+		{name: "port in host and list", entry: RuleEntry{Host: "a.example.com:443", Ports: []string{"8443"}}, wantErr: true},
+		{name: "reversed range", entry: RuleEntry{Host: "a.example.com", Ports: []string{"8450-8443"}}, wantErr: true},
+		{name: "overlapping ranges", entry: RuleEntry{Host: "a.example.com", Ports: []string{"8443-8450", "8450"}}, wantErr: true},
+		{name: "duplicate port", entry: RuleEntry{Host: "a.example.com", Ports: []string{"443", "443"}}, wantErr: true},
+		{name: "out of range", entry: RuleEntry{Host: "a.example.com", Ports: []string{"1-65536"}}, wantErr: true},
+		{name: "not a number", entry: RuleEntry{Host: "a.example.com", Ports: []string{"https"}}, wantErr: true},
+		{name: "open range", entry: RuleEntry{Host: "a.example.com", Ports: []string{"8443-"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseRule(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRule(%v) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			}
+			if !tt.wantErr && rule.Ports.String() != tt.ports {
+				t.Errorf("parseRule(%v) ports = %q, want %q", tt.entry, rule.Ports, tt.ports)
+			}
+		})
+	}
+}
+
+func TestRuleSetMatchPortSets(t *testing.T) {
+	set, err := compileRules([]RuleEntry{
+		{Host: "api.example.com", Ports: []string{"443", "8443-8450"}},
+		{Host: "*.example.net", Ports: []string{"80", "443"}},
+		{Host: "10.20.0.0/16", Ports: []string{"5432-5433"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	tests := []struct {
+		host    string
+		port    string
+		allowed bool
+	}{
+		{host: "api.example.com", port: "443", allowed: true},
+		{host: "api.example.com", port: "8443", allowed: true},
+		{host: "api.example.com", port: "8447", allowed: true},
+		{host: "api.example.com", port: "8450", allowed: true},
+		{host: "api.example.com", port: "8451", allowed: false},
+		{host: "api.example.com", port: "9443", allowed: false},
+		{host: "api.example.com", port: "not-a-port", allowed: false},
+		{host: "www.example.net", port: "80", allowed: true},
+		{host: "www.example.net", port: "8080", allowed: false},
+		{host: "10.20.1.1", port: "5433", allowed: true},
+		{host: "10.20.1.1", port: "5434", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+":"+tt.port, func(t *testing.T) {
+			if _, ok := set.match(tt.host, tt.port); ok != tt.allowed {
+				t.Errorf("match(%s, %s) = %v, want %v", tt.host, tt.port, ok, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCompileRulesSamePortsDifferentOrder(t *testing.T) {
+	_, err := compileRules([]RuleEntry{
+		{Host: "api.example.com", Ports: []string{"443", "8443"}},
+		{Host: "api.example.com", Ports: []string{"8443", "443"}},
+	})
+	if err == nil {
+		t.Error("Expected error for entries with the same host and ports")
+	}
+}
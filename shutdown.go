@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// trackedTunnel holds both ends of an active tunnel so Shutdown can close them
+type trackedTunnel struct {
+	client, dest net.Conn
+	forceClosed  bool // set under ProxyServer.mu when Shutdown closed the tunnel
+}
+
+// shutdownResponse is sent on a hijacked CONNECT connection whose tunnel
+// could not start because Shutdown began after its destination was dialed
+const shutdownResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: 44\r\n" +
+	"\r\n" +
+	"Service Unavailable: proxy is shutting down\n"
+
+// trackTunnel registers an active tunnel, or returns false if the proxy is
+// shutting down and the tunnel must not start. untrackTunnel must be called
+// when a tracked tunnel ends.
+func (p *ProxyServer) trackTunnel(client, dest net.Conn) (*trackedTunnel, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		return nil, false
+	}
+
+	t := &trackedTunnel{client: client, dest: dest}
+	p.tunnels[t] = struct{}{}
+	p.tunnelsWG.Add(1)
+	return t, true
+}
+
+// untrackTunnel removes a tunnel registered by trackTunnel and reports
+// whether Shutdown force-closed it
+func (p *ProxyServer) untrackTunnel(t *trackedTunnel) bool {
+	p.mu.Lock()
+	delete(p.tunnels, t)
+	forceClosed := t.forceClosed
+	p.mu.Unlock()
+	p.tunnelsWG.Done()
+	return forceClosed
+}
+
+// logNotStarted logs the connection_closed that ends an allowed connection
+// whose tunnel was refused because the proxy is shutting down, so every
+// allowed connection_attempt is still followed by one
+func (p *ProxyServer) logNotStarted(entry LogEntry, destIP *net.IPAddr) {
+	entry.Level = LogLevelInfo
+	entry.Event = "connection_closed"
+	entry.ResolvedIP = ipString(destIP)
+	entry.ClosedBy = "proxy"
+	entry.Reason = "shutdown"
+	p.logger.Log(entry)
+}
+
+// isClosing reports whether Shutdown has been called
+func (p *ProxyServer) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// Shutdown stops accepting connections, waits up to drain for active tunnels
+// and forwarded requests to finish, then force-closes whatever is left. It
+// logs proxy_stopping and proxy_stopped and returns the number of tunnels it
+// had to close.
+func (p *ProxyServer) Shutdown(reason string, drain time.Duration) int {
+	p.mu.Lock()
+	p.closing = true
+	server, socksListener, metricsServer := p.server, p.socksListener, p.metricsServer
+	active := len(p.tunnels)
+	p.mu.Unlock()
+
+	p.logger.Log(LogEntry{
+		Level:   LogLevelInfo,
+		Event:   "proxy_stopping",
+		Message: "Draining connections after " + reason,
+		Extra: map[string]interface{}{
+			"active_tunnels": active,
+			"drain_timeout":  drain.String(),
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	if socksListener != nil {
+		socksListener.Close()
+	}
+	// Shutdown closes the listener and waits for forwarded requests, but
+	// not for hijacked CONNECT tunnels, which are tracked separately
+	if server != nil {
+		server.Shutdown(ctx)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.tunnelsWG.Wait()
+		close(drained)
+	}()
+
+	closed := 0
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		closed = p.closeTunnels()
+		if server != nil {
+			server.Close()
+		}
+		<-drained
+	}
+
+	// Metrics stay available while draining so the drain can be watched
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	p.logger.Log(LogEntry{
+		Level:   LogLevelInfo,
+		Event:   "proxy_stopped",
+		Message: "Proxy stopped",
+		Extra: map[string]interface{}{
+			"connections_closed": closed,
+		},
+	})
+	return closed
+}
+
+// closeTunnels closes both ends of every active tunnel and returns how many
+// there were
+func (p *ProxyServer) closeTunnels() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for t := range p.tunnels {
+		t.forceClosed = true
+		t.client.Close()
+		t.dest.Close()
+	}
+	return len(p.tunnels)
+}
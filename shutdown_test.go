@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveTestProxy runs proxy.Serve on a loopback listener and returns its
+// address and a channel receiving Serve's result
+func serveTestProxy(t *testing.T, proxy *ProxyServer) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- proxy.Serve(listener, nil) }()
+	return listener.Addr().String(), done
+}
+
+// newEchoTunnelProxy returns a proxy allowlisting a fresh echo server
+func newEchoTunnelProxy(t *testing.T) (*ProxyServer, *syncBuffer, string) {
+	t.Helper()
+	echo := startEchoServer(t)
+	proxy := newTestProxy(t, fmt.Sprintf("allowlist:\n  - %s\n", echo.Addr()))
+	logs := &syncBuffer{}
+	proxy.logger = NewLogger(logs)
+	return proxy, logs, echo.Addr().String()
+}
+
+// waitForTunnels polls until proxy has n active tunnels
+func waitForTunnels(t *testing.T, proxy *ProxyServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		proxy.mu.Lock()
+		active := len(proxy.tunnels)
+		proxy.mu.Unlock()
+		if active == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d tunnels, have %d", n, active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsTunnels(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxyAddr, served := serveTestProxy(t, proxy)
+
+	conn, _, status := connectThrough(t, proxyAddr, dest)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	waitForTunnels(t, proxy, 1)
+
+	stopped := make(chan int, 1)
+	go func() { stopped <- proxy.Shutdown("test", 5*time.Second) }()
+
+	// The listener stops accepting while the tunnel keeps working
+	waitForEvent(t, logs, "proxy_stopping")
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v after Shutdown", err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Tunnel should keep working while draining: %q %v", buf, err)
+	}
+	if _, err := net.DialTimeout("tcp", proxyAddr, time.Second); err == nil {
+		t.Error("Listener should be closed while draining")
+	}
+
+	conn.Close()
+	select {
+	case closed := <-stopped:
+		if closed != 0 {
+			t.Errorf("Expected no connections to be force-closed, got %d", closed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after the tunnel finished")
+	}
+
+	entry := waitForEvent(t, logs, "proxy_stopped")
+	if entry.Extra["connections_closed"] != float64(0) {
+		t.Errorf("Expected connections_closed 0, got %v", entry.Extra["connections_closed"])
+	}
+}
+
+func TestShutdownForceClosesAfterDrain(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxyAddr, served := serveTestProxy(t, proxy)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, status := connectThrough(t, proxyAddr, dest)
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitForTunnels(t, proxy, 2)
+
+	start := time.Now()
+	if closed := proxy.Shutdown("test", 100*time.Millisecond); closed != 2 {
+		t.Errorf("Expected 2 connections to be force-closed, got %d", closed)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v, expected about the drain timeout", elapsed)
+	}
+	<-served
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected tunnel to be closed")
+		}
+	}
+
+	entries := logEntries(t, logs.snapshot())
+	for _, entry := range entries {
+		if entry.Event == "connection_closed" && (entry.ClosedBy != "proxy" || entry.Reason != "shutdown") {
+			t.Errorf("Expected tunnel closed by proxy for shutdown, got %+v", entry)
+		}
+	}
+	last := entries[len(entries)-1]
+	if last.Event != "proxy_stopped" || last.Extra["connections_closed"] != float64(2) {
+		t.Errorf("Expected proxy_stopped with 2 connections closed last, got %+v", last)
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	proxy, _, _ := newEchoTunnelProxy(t)
+	proxy.Shutdown("test", time.Second)
+
+	_, served := serveTestProxy(t, proxy)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve after Shutdown returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve should return immediately after Shutdown")
+	}
+}
+
+func TestConnectWhileClosing(t *testing.T) {
+	proxy, logs, dest := newEchoTunnelProxy(t)
+	proxy.mu.Lock()
+	proxy.closing = true
+	proxy.mu.Unlock()
+
+	req := httptest.NewRequest("CONNECT", "http://"+dest, nil)
+	req.Host = dest
+	w := httptest.NewRecorder()
+	proxy.handleConnect(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d while shutting down, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	closed := waitForEvent(t, logs, "connection_closed")
+	if closed.ClosedBy != "proxy" || closed.Reason != "shutdown" {
+		t.Errorf("Expected the attempt to be closed for shutdown, got %+v", closed)
+	}
+
+	socksAddr := startSOCKS(t, proxy)
+	host, port, _ := net.SplitHostPort(dest)
+	portNum, _ := strconv.Atoi(port)
+	conn, reply := socksConnect(t, socksAddr, socksCmdConnect, socksAtypIPv4, net.ParseIP(host).To4(), portNum)
+	defer conn.Close()
+	if reply != socksReplyGeneralFailure {
+		t.Errorf("Expected a general failure reply while shutting down, got %d", reply)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// VerifySNI is set at compile time using -ldflags "-X main.VerifySNI=true"
+var VerifySNI = "false"
+
+// sniReadTimeout bounds how long the proxy waits for a client's first bytes
+// and ClientHello before giving up on SNI verification
+const sniReadTimeout = 10 * time.Second
+
+// tlsRecordTypeHandshake is the content type of the record carrying a ClientHello
+const tlsRecordTypeHandshake = 0x16
+
+// errClientHelloCaptured aborts the handshake once the ClientHello is parsed
+var errClientHelloCaptured = errors.New("client hello captured")
+
+// helloRecorder feeds a TLS server handshake from a reader while keeping a
+// copy of everything read, and discards anything the handshake writes
+type helloRecorder struct {
+	net.Conn
+	reader   io.Reader
+	consumed bytes.Buffer
+}
+
+func (c *helloRecorder) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	c.consumed.Write(b[:n])
+	return n, err
+}
+
+func (c *helloRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// readClientHello parses the ClientHello arriving on r without terminating
+// TLS. It returns the requested server name and every byte read from r, which
+// must be forwarded to the destination before the rest of the stream.
+func readClientHello(conn net.Conn, r io.Reader) (string, []byte, error) {
+	recorder := &helloRecorder{Conn: conn, reader: r}
+
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(recorder, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloCaptured
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return "", recorder.consumed.Bytes(), err
+	}
+	return hello.ServerName, recorder.consumed.Bytes(), nil
+}
+
+// sniMismatch compares the server name from a ClientHello with the tunnel's
+// destination and returns why it is unacceptable, or "" if it is fine. The
+// name must equal the destination host or be allowlisted for the same port
+// in its own right under policy; IP destinations may omit it.
+func (p *ProxyServer) sniMismatch(policy *policySet, destination, serverName string) string {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return "invalid_destination"
+	}
+
+	if serverName == "" {
+		if net.ParseIP(host) != nil {
+			return ""
+		}
+		return "missing_sni"
+	}
+
+	if strings.EqualFold(strings.TrimSuffix(serverName, "."), strings.TrimSuffix(host, ".")) {
+		return ""
+	}
+	if _, denied := policy.denylist.match(serverName, port); denied {
+		return "sni_denied"
+	}
+	if _, allowed := policy.allowlist.match(serverName, port); allowed {
+		return ""
+	}
+	return "sni_not_allowed"
+}
+
+// checkSNI inspects the first bytes the client sends through a tunnel. If
+// they start a TLS handshake, the ClientHello's server name is checked with
+// sniMismatch and a mismatch is logged as sni_mismatch. Accepted bytes are
+// written to dest; false means the tunnel must be closed. Streams that are
+// not TLS are left alone.
+func (p *ProxyServer) checkSNI(entry LogEntry, client net.Conn, r *bufio.Reader, dest io.Writer) bool {
+	client.SetReadDeadline(time.Now().Add(sniReadTimeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	first, err := r.Peek(1)
+	if err != nil || first[0] != tlsRecordTypeHandshake {
+		return true
+	}
+
+	serverName, consumed, err := readClientHello(client, r)
+	reason := "unreadable_client_hello"
+	if err == nil {
+		reason = p.sniMismatch(p.policyFor(entry.User), entry.Destination, serverName)
+	}
+
+	if reason != "" {
+		entry.Level = LogLevelWarning
+		entry.Event = "sni_mismatch"
+		entry.Action = "closed"
+		if p.discoveryMode {
+			entry.Action = "allowed_discovery"
+		}
+		entry.SNI = serverName
+		entry.Reason = reason
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		p.logger.Log(entry)
+
+		if !p.discoveryMode {
+			return false
+		}
+	}
+
+	_, err = dest.Write(consumed)
+	return err == nil
+}
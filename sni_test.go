@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSNIMismatch(t *testing.T) {
+	proxy := newTestProxy(t, `allowlist:
+  - api.example.com:443
+  - cdn.example.net:443
+  - 10.20.0.0/16:443
+denylist:
+  - admin.example.net
+`)
+
+	tests := []struct {
+		destination string
+		serverName  string
+		reason      string
+	}{
+		{destination: "api.example.com:443", serverName: "api.example.com", reason: ""},
+		{destination: "api.example.com:443", serverName: "API.example.com.", reason: ""},
+		{destination: "api.example.com:443", serverName: "cdn.example.net", reason: ""},
+		{destination: "api.example.com:443", serverName: "evil.com", reason: "sni_not_allowed"},
+		{destination: "api.example.com:443", serverName: "admin.example.net", reason: "sni_denied"},
+		{destination: "api.example.com:443", serverName: "", reason: "missing_sni"},
+		{destination: "10.20.0.5:443", serverName: "", reason: ""},
+		{destination: "10.20.0.5:443", serverName: "api.example.com", reason: ""},
+		{destination: "10.20.0.5:443", serverName: "evil.com", reason: "sni_not_allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.destination+"/"+tt.serverName, func(t *testing.T) {
+			if reason := proxy.sniMismatch(proxy.defaultPolicy, tt.destination, tt.serverName); reason != tt.reason {
+				t.Errorf("sniMismatch(%s, %s) = %q, want %q", tt.destination, tt.serverName, reason, tt.reason)
+			}
+		})
+	}
+}
+
+// newSNITestProxy serves a proxy with SNI verification on, allowlisting
+// local.example.com and other.example.com on the port of dest, both of which
+// resolve to the loopback address dest listens on
+func newSNITestProxy(t *testing.T, dest net.Addr) (*ProxyServer, *syncBuffer, string) {
+	t.Helper()
+	port := dest.(*net.TCPAddr).Port
+	proxy := newTestProxy(t, fmt.Sprintf(`allowlist:
+  - local.example.com:%d
+  - other.example.com:%d
+forbidden_ranges: []
+`, port, port))
+	proxy.resolver = staticResolver{
+		"local.example.com": {"127.0.0.1"},
+		"other.example.com": {"127.0.0.1"},
+	}
+	proxy.verifySNI = true
+	logs := &syncBuffer{}
+	proxy.logger = NewLogger(logs)
+
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+	return proxy, logs, proxyServer.Listener.Addr().String()
+}
+
+func TestCheckSNITunnel(t *testing.T) {
+	destServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer destServer.Close()
+	port := destServer.Listener.Addr().(*net.TCPAddr).Port
+
+	_, logs, proxyAddr := newSNITestProxy(t, destServer.Listener.Addr())
+	dest := fmt.Sprintf("local.example.com:%d", port)
+
+	tests := []struct {
+		name       string
+		serverName string
+		wantOK     bool
+	}{
+		{name: "matching", serverName: "local.example.com", wantOK: true},
+		{name: "other allowlisted name", serverName: "other.example.com", wantOK: true},
+		{name: "fronted name", serverName: "evil.com", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, status := connectThrough(t, proxyAddr, dest)
+			defer conn.Close()
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", status)
+			}
+
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+			err := tlsConn.Handshake()
+			if tt.wantOK && err != nil {
+				t.Fatalf("Handshake failed: %v", err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Fatal("Handshake should fail when the tunnel is closed")
+			}
+		})
+	}
+
+	entry := waitForEvent(t, logs, "sni_mismatch")
+	if entry.SNI != "evil.com" || entry.Reason != "sni_not_allowed" || entry.Action != "closed" {
+		t.Errorf("Unexpected sni_mismatch entry: %+v", entry)
+	}
+	if entry.Destination != dest {
+		t.Errorf("Expected destination %s, got %s", dest, entry.Destination)
+	}
+}
+
+func TestCheckSNIIgnoresPlaintext(t *testing.T) {
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer destServer.Close()
+	port := destServer.Listener.Addr().(*net.TCPAddr).Port
+
+	_, _, proxyAddr := newSNITestProxy(t, destServer.Listener.Addr())
+
+	conn, reader, status := connectThrough(t, proxyAddr, fmt.Sprintf("local.example.com:%d", port))
+	defer conn.Close()
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: local.example.com\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read tunneled response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "OK" {
+		t.Errorf("Expected body OK, got %q", body)
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true}).Handshake()
+
+	serverName, consumed, err := readClientHello(server, bufio.NewReader(server))
+	if err != nil {
+		t.Fatalf("readClientHello failed: %v", err)
+	}
+	if serverName != "api.example.com" {
+		t.Errorf("Expected server name api.example.com, got %q", serverName)
+	}
+	if len(consumed) < 5 || consumed[0] != tlsRecordTypeHandshake {
+		t.Errorf("Consumed bytes should start with a handshake record, got % x", consumed)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants from RFC 1928
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAtypNotSupported    = 0x08
+)
+
+// Username/password authentication constants from RFC 1929
+const (
+	socksUserPassVersion = 0x01
+	socksUserPassSuccess = 0x00
+	socksUserPassFailure = 0x01
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its
+// greeting and request
+const socksHandshakeTimeout = 30 * time.Second
+
+// socksReplyError is a handshake failure that should be reported to the
+// client with the given reply code
+type socksReplyError struct {
+	code byte
+	msg  string
+}
+
+func (e *socksReplyError) Error() string {
+	return e.msg
+}
+
+// serveSOCKS accepts SOCKS5 clients on listener until it is closed
+func (p *ProxyServer) serveSOCKS(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleSOCKS(conn)
+	}
+}
+
+// handleSOCKS serves a single SOCKS5 client. Only the CONNECT command is
+// supported, without authentication or, when the proxy requires it, with a
+// username and password; destinations go through the same checks as HTTP
+// CONNECT requests.
+func (p *ProxyServer) handleSOCKS(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	process := newClientProcess(clientConn.RemoteAddr().String(), clientConn.LocalAddr().String())
+	base := newClientEntry("socks5", process)
+	failed := func(err error) {
+		entry := base
+		entry.Level = LogLevelWarning
+		entry.Event = "socks_handshake_failed"
+		entry.Error = err.Error()
+		p.logger.Log(entry)
+	}
+
+	// The client limit comes first, so a flood of connections costs no
+	// process lookups, and before credentials are checked, so it covers
+	// password guessing as well. The refusal is sent once the client has
+	// negotiated a method it can be sent in.
+	limited := p.limitClient(base)
+	if limited == nil {
+		process.identify(&base)
+	}
+
+	clientConn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	method := byte(socksMethodNoAuth)
+	if p.auth != nil {
+		method = socksMethodUserPass
+	}
+	if err := socksNegotiate(clientConn, method); err != nil {
+		if limited == nil {
+			failed(err)
+		}
+		return
+	}
+
+	if limited != nil {
+		if p.auth != nil {
+			clientConn.Write([]byte{socksUserPassVersion, socksUserPassFailure})
+		} else if _, err := socksReadRequest(clientConn); err == nil {
+			socksReply(clientConn, socksReplyGeneralFailure, nil)
+		}
+		return
+	}
+	if p.auth != nil {
+		name, password, err := socksReadCredentials(clientConn)
+		if err != nil {
+			failed(err)
+			return
+		}
+		user, err := p.auth.authenticate(name, password)
+		if err != nil {
+			clientConn.Write([]byte{socksUserPassVersion, socksUserPassFailure})
+			p.logAuthFailed(base, name, err)
+			return
+		}
+		if _, err := clientConn.Write([]byte{socksUserPassVersion, socksUserPassSuccess}); err != nil {
+			return
+		}
+		base.User = user.Name
+	}
+
+	destHost, err := socksReadRequest(clientConn)
+	if err != nil {
+		var replyErr *socksReplyError
+		if errors.As(err, &replyErr) {
+			socksReply(clientConn, replyErr.code, nil)
+		}
+		failed(err)
+		return
+	}
+
+	base.Destination = destHost
+	decision := p.authorize(&base)
+	if decision.limited != nil {
+		socksReply(clientConn, socksReplyGeneralFailure, nil)
+		return
+	}
+	if !decision.Allowed {
+		socksReply(clientConn, socksReplyNotAllowed, nil)
+		return
+	}
+
+	destConn, destIP, err := p.dialDestination(context.Background(), p.policyFor(base.User), destHost)
+	if err != nil {
+		if p.logDialFailure(base, destIP, err) {
+			socksReply(clientConn, socksReplyNotAllowed, nil)
+		} else {
+			socksReply(clientConn, classifyDialError(err).Reply, nil)
+		}
+		return
+	}
+	defer destConn.Close()
+
+	// Success is only reported for a tunnel Shutdown will wait for
+	tracked, ok := p.trackTunnel(clientConn, destConn)
+	if !ok {
+		p.logNotStarted(base, destIP)
+		socksReply(clientConn, socksReplyGeneralFailure, nil)
+		return
+	}
+	if err := socksReply(clientConn, socksReplySucceeded, destConn.LocalAddr()); err != nil {
+		p.untrackTunnel(tracked)
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	p.tunnel(base, tracked, decision.rule, clientConn, bufio.NewReader(clientConn), destConn, destIP)
+}
+
+// socksNegotiate reads the client greeting and selects method, refusing
+// clients that do not offer it
+func socksNegotiate(conn net.Conn, method byte) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("reading greeting: %w", err)
+	}
+	if header[0] != socksVersion5 {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("reading methods: %w", err)
+	}
+	for _, offered := range methods {
+		if offered == method {
+			_, err := conn.Write([]byte{socksVersion5, method})
+			return err
+		}
+	}
+
+	conn.Write([]byte{socksVersion5, socksMethodNoAcceptable})
+	return fmt.Errorf("client offered no supported authentication method")
+}
+
+// socksReadCredentials reads a username/password request
+func socksReadCredentials(conn net.Conn) (name, password string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", fmt.Errorf("reading credentials: %w", err)
+	}
+	if header[0] != socksUserPassVersion {
+		return "", "", fmt.Errorf("unsupported username/password version %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", "", fmt.Errorf("reading username: %w", err)
+	}
+
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", "", fmt.Errorf("reading password length: %w", err)
+	}
+	pass := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", "", fmt.Errorf("reading password: %w", err)
+	}
+	return string(user), string(pass), nil
+}
+
+// socksReadRequest reads a request and returns its destination as host:port.
+// Domain names are passed on unresolved so the allowlist sees the name.
+func socksReadRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("reading request: %w", err)
+	}
+	if header[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if header[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		addr := make([]byte, size)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", fmt.Errorf("reading address: %w", err)
+		}
+		host = net.IP(addr).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", fmt.Errorf("reading domain length: %w", err)
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", fmt.Errorf("reading domain: %w", err)
+		}
+		host = string(name)
+	default:
+		return "", &socksReplyError{code: socksReplyAtypNotSupported, msg: fmt.Sprintf("unsupported address type %d", header[3])}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("reading port: %w", err)
+	}
+
+	// The command is checked after the whole request is read so the reply
+	// is not interleaved with unread request bytes
+	if header[1] != socksCmdConnect {
+		return "", &socksReplyError{code: socksReplyCommandNotSupported, msg: fmt.Sprintf("unsupported command %d", header[1])}
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply sends a reply with the given code and bound address; a nil
+// address is sent as 0.0.0.0:0
+func socksReply(conn net.Conn, code byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+
+	reply := []byte{socksVersion5, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socksAtypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socksAtypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port))
+
+	_, err := conn.Write(reply)
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startSOCKS serves proxy's SOCKS5 handler on a random local port
+func startSOCKS(t *testing.T, proxy *ProxyServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go proxy.serveSOCKS(listener)
+	return listener.Addr().String()
+}
+
+// socksConnect performs a no-auth handshake and CONNECT request with the
+// given address type and raw address bytes, returning the reply code
+func socksConnect(t *testing.T, socksAddr string, cmd, atyp byte, addr []byte, port int) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial SOCKS listener: %v", err)
+	}
+
+	conn.Write([]byte{socksVersion5, 1, socksMethodNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksMethodNoAuth {
+		t.Fatalf("Method negotiation failed: %v %v", method, err)
+	}
+
+	request := []byte{socksVersion5, cmd, 0x00, atyp}
+	if atyp == socksAtypDomain {
+		request = append(request, byte(len(addr)))
+	}
+	request = append(request, addr...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	conn.Write(request)
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	bound := net.IPv4len
+	if reply[3] == socksAtypIPv6 {
+		bound = net.IPv6len
+	}
+	io.ReadFull(conn, make([]byte, bound+2))
+	return conn, reply[1]
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer destServer.Close()
+	destAddr := destServer.Listener.Addr().(*net.TCPAddr)
+
+	proxy := newTestProxy(t, fmt.Sprintf("allowlist:\n  - 127.0.0.1:%d\n  - local.example.com:%d\n", destAddr.Port, destAddr.Port))
+	proxy.resolver = staticResolver{"local.example.com": {"127.0.0.1"}}
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	socksAddr := startSOCKS(t, proxy)
+
+	tests := []struct {
+		name string
+		atyp byte
+		addr []byte
+	}{
+		{name: "ipv4", atyp: socksAtypIPv4, addr: net.ParseIP("127.0.0.1").To4()},
+		{name: "domain", atyp: socksAtypDomain, addr: []byte("local.example.com")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, code := socksConnect(t, socksAddr, socksCmdConnect, tt.atyp, tt.addr, destAddr.Port)
+			defer conn.Close()
+			if code != socksReplySucceeded {
+				t.Fatalf("Expected reply %d, got %d", socksReplySucceeded, code)
+			}
+
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read tunneled response: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "OK" {
+				t.Errorf("Expected body OK, got %q", body)
+			}
+		})
+	}
+
+	attempt := waitForEvent(t, &logs, "connection_attempt")
+	if attempt.Protocol != "socks5" || attempt.Action != "allowed" {
+		t.Errorf("Unexpected connection_attempt entry: %+v", attempt)
+	}
+	if want := "127.0.0.1:" + strconv.Itoa(destAddr.Port); attempt.Destination != want {
+		t.Errorf("Expected destination %s, got %s", want, attempt.Destination)
+	}
+}
+
+func TestSOCKSRefusals(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com:443\n  - rebind.example.com:443\n")
+	proxy.resolver = staticResolver{"rebind.example.com": {"127.0.0.1"}}
+	var logs syncBuffer
+	proxy.logger = NewLogger(&logs)
+	socksAddr := startSOCKS(t, proxy)
+
+	tests := []struct {
+		name   string
+		cmd    byte
+		atyp   byte
+		addr   []byte
+		port   int
+		code   byte
+		action string
+	}{
+		{name: "not allowlisted", cmd: socksCmdConnect, atyp: socksAtypDomain, addr: []byte("evil.com"), port: 443, code: socksReplyNotAllowed, action: "blocked"},
+		{name: "wrong port", cmd: socksCmdConnect, atyp: socksAtypDomain, addr: []byte("example.com"), port: 22, code: socksReplyNotAllowed, action: "blocked"},
+		{name: "ipv6 not allowlisted", cmd: socksCmdConnect, atyp: socksAtypIPv6, addr: net.ParseIP("2001:db8::1"), port: 443, code: socksReplyNotAllowed, action: "blocked"},
+		{name: "forbidden resolution", cmd: socksCmdConnect, atyp: socksAtypDomain, addr: []byte("rebind.example.com"), port: 443, code: socksReplyNotAllowed, action: "blocked_resolved_ip"},
+		{name: "bind command", cmd: 0x02, atyp: socksAtypDomain, addr: []byte("example.com"), port: 443, code: socksReplyCommandNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, code := socksConnect(t, socksAddr, tt.cmd, tt.atyp, tt.addr, tt.port)
+			conn.Close()
+			if code != tt.code {
+				t.Errorf("Expected reply %d, got %d", tt.code, code)
+			}
+		})
+	}
+
+	output := logs.snapshot().String()
+	for _, want := range []string{`"destination":"evil.com:443"`, `"destination":"[2001:db8::1]:443"`, `"action":"blocked_resolved_ip"`, `"protocol":"socks5"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected log to contain %s, got: %s", want, output)
+		}
+	}
+}
+
+func TestSOCKSRejectsAuthOnlyClients(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com\n")
+	socksAddr := startSOCKS(t, proxy)
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial SOCKS listener: %v", err)
+	}
+	defer conn.Close()
+
+	// Offer only username/password authentication
+	conn.Write([]byte{socksVersion5, 1, 0x02})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read method selection: %v", err)
+	}
+	if reply[1] != socksMethodNoAcceptable {
+		t.Errorf("Expected method 0x%x, got 0x%x", socksMethodNoAcceptable, reply[1])
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTunnelTimeouts apply unless allowlist.yaml sets its own under
+// timeouts. Zero disables a timeout.
+var defaultTunnelTimeouts = tunnelTimeouts{
+	Idle:        15 * time.Minute,
+	MaxLifetime: 24 * time.Hour,
+}
+
+// TimeoutConfig is the timeouts section of allowlist.yaml. Durations are
+// written as "90s", "15m" or "24h"; "0s" disables a timeout.
+type TimeoutConfig struct {
+	// Idle closes a tunnel once neither side has sent anything for this long
+	Idle *time.Duration `yaml:"idle"`
+	// MaxLifetime closes a tunnel this long after it opened, busy or not
+	MaxLifetime *time.Duration `yaml:"max_lifetime"`
+}
+
+// tunnelTimeouts bound how long a tunnel may stay open
+type tunnelTimeouts struct {
+	Idle        time.Duration
+	MaxLifetime time.Duration
+}
+
+// loadTimeouts loads the tunnel timeouts, falling back to
+// defaultTunnelTimeouts for any the configuration leaves out
+func loadTimeouts(config *Config) (tunnelTimeouts, error) {
+	timeouts, err := defaultTunnelTimeouts.override(config.Timeouts.Idle, config.Timeouts.MaxLifetime)
+	if err != nil {
+		return tunnelTimeouts{}, fmt.Errorf("invalid timeouts in allowlist.yaml: %w", err)
+	}
+	return timeouts, nil
+}
+
+// override returns t with the timeouts that are set replaced
+func (t tunnelTimeouts) override(idle, maxLifetime *time.Duration) (tunnelTimeouts, error) {
+	if idle != nil {
+		if *idle < 0 {
+			return t, fmt.Errorf("idle timeout %s is negative", *idle)
+		}
+		t.Idle = *idle
+	}
+	if maxLifetime != nil {
+		if *maxLifetime < 0 {
+			return t, fmt.Errorf("max lifetime %s is negative", *maxLifetime)
+		}
+		t.MaxLifetime = *maxLifetime
+	}
+	return t, nil
+}
+
+// forRule returns the timeouts for a tunnel permitted by rule, which may be
+// nil in discovery mode
+func (t tunnelTimeouts) forRule(rule *hostRule) tunnelTimeouts {
+	if rule == nil {
+		return t
+	}
+	// parseRule has already rejected negative overrides
+	t, _ = t.override(rule.IdleTimeout, rule.MaxLifetime)
+	return t
+}
+
+// tunnelActivity records when either direction of a tunnel last moved data,
+// so a direction that is quiet only because the traffic is one-way is not
+// mistaken for an idle tunnel
+type tunnelActivity struct {
+	idle time.Duration
+	last int64 // UnixNano of the last read from either side
+}
+
+func newTunnelActivity(idle time.Duration) *tunnelActivity {
+	return &tunnelActivity{idle: idle, last: time.Now().UnixNano()}
+}
+
+func (a *tunnelActivity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *tunnelActivity) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// copy copies src to dst like io.Copy, through shaper when it is not nil.
+// With an idle timeout, every read is bounded by a deadline on conn, the
+// connection src reads from, that is pushed back whenever either direction
+// makes progress. copy returns the reason when the proxy ends the copy
+// itself: idle_timeout once a deadline passes with the whole tunnel quiet,
+// or quota_exceeded along with the shaper's quotaError.
+func (a *tunnelActivity) copy(dst io.Writer, src io.Reader, conn net.Conn, shaper *trafficShaper) (reason string, err error) {
+	buf := make([]byte, shaper.bufferSize(32*1024))
+	for {
+		if a.idle > 0 {
+			conn.SetReadDeadline(a.lastActive().Add(a.idle))
+		}
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			a.touch()
+			if err := shaper.admit(n); err != nil {
+				return "quota_exceeded", err
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if readErr == nil {
+			continue
+		}
+		if readErr == io.EOF {
+			return "", nil
+		}
+
+		var netErr net.Error
+		if a.idle > 0 && errors.As(readErr, &netErr) && netErr.Timeout() {
+			if time.Since(a.lastActive()) >= a.idle {
+				return "idle_timeout", nil
+			}
+			// The other direction was busy; wait for the new deadline
+			continue
+		}
+		return "", readErr
+	}
+}
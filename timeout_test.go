@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadTimeouts(t *testing.T) {
+	proxy := newTestProxy(t, "allowlist:\n  - example.com\n")
+	if proxy.timeouts != defaultTunnelTimeouts {
+		t.Errorf("Expected default timeouts, got %+v", proxy.timeouts)
+	}
+
+	proxy = newTestProxy(t, `timeouts:
+  idle: 90s
+  max_lifetime: 0s
+allowlist:
+  - example.com
+  - {host: git.example.com, ports: [22], idle_timeout: 2h}
+`)
+	if proxy.timeouts.Idle != 90*time.Second || proxy.timeouts.MaxLifetime != 0 {
+		t.Errorf("Expected idle 90s and no max lifetime, got %+v", proxy.timeouts)
+	}
+
+	rule, ok := proxy.allowlist.match("git.example.com", "22")
+	if !ok {
+		t.Fatal("git.example.com:22 should be allowed")
+	}
+	if got := proxy.timeouts.forRule(rule); got.Idle != 2*time.Hour || got.MaxLifetime != 0 {
+		t.Errorf("Expected the entry's idle timeout to override, got %+v", got)
+	}
+	if got := proxy.timeouts.forRule(nil); got != proxy.timeouts {
+		t.Errorf("Expected the configured timeouts without a rule, got %+v", got)
+	}
+	if rule.Entry != "git.example.com ports [22] idle_timeout 2h0m0s" {
+		t.Errorf("Unexpected entry text %q", rule.Entry)
+	}
+}
+
+func TestLoadTimeoutsInvalid(t *testing.T) {
+	configs := []string{
+		"timeouts:\n  idle: -1s\nallowlist:\n  - example.com\n",
+		"timeouts:\n  max_lifetime: forever\nallowlist:\n  - example.com\n",
+		"allowlist:\n  - {host: example.com, max_lifetime: -5m}\n",
+		"allowlist:\n  - example.com\ndenylist:\n  - {host: bad.example.com, idle_timeout: 1m}\n",
+	}
+	original := allowlistYAML
+	defer func() { allowlistYAML = original }()
+	for _, config := range configs {
+		allowlistYAML = []byte(config)
+		if _, err := NewProxyServer("localhost:0", NewLogger(io.Discard)); err == nil {
+			t.Errorf("Expected an error for config:\n%s", config)
+		}
+	}
+}
+
+func TestTunnelActivityCopy(t *testing.T) {
+	// One-way traffic in the other direction keeps a quiet copy alive
+	activity := newTunnelActivity(100 * time.Millisecond)
+	quiet, quietPeer := net.Pipe()
+	defer quietPeer.Close()
+
+	done := make(chan bool, 1)
+	go func() {
+		reason, _ := activity.copy(io.Discard, quiet, quiet, nil)
+		done <- reason == "idle_timeout"
+	}()
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(40 * time.Millisecond)
+		activity.touch()
+	}
+	select {
+	case <-done:
+		t.Fatal("Copy stopped while the other direction was busy")
+	default:
+	}
+
+	select {
+	case idle := <-done:
+		if !idle {
+			t.Error("Expected the copy to report idle")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Copy did not time out")
+	}
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	echo := startEchoServer(t)
+	dest := echo.Addr().String()
+
+	tests := []struct {
+		name   string
+		config string
+		reason string
+		busy   bool // keep the tunnel busy so only max_lifetime can end it
+	}{
+		{"idle", fmt.Sprintf("timeouts:\n  idle: 200ms\nallowlist:\n  - %s\n", dest), "idle_timeout", false},
+		{"entry idle override", fmt.Sprintf("timeouts:\n  idle: 1h\nallowlist:\n  - {host: %q, idle_timeout: 200ms}\n", dest), "idle_timeout", false},
+		{"max lifetime", fmt.Sprintf("timeouts:\n  idle: 150ms\n  max_lifetime: 400ms\nallowlist:\n  - %s\n", dest), "max_lifetime", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, tt.config)
+			logs := &syncBuffer{}
+			proxy.logger = NewLogger(logs)
+			proxyServer := httptest.NewServer(proxy)
+			defer proxyServer.Close()
+
+			conn, reader, status := connectThrough(t, proxyServer.Listener.Addr().String(), dest)
+			defer conn.Close()
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", status)
+			}
+
+			started := time.Now()
+			if tt.busy {
+				go func() {
+					for {
+						if _, err := conn.Write([]byte("ping")); err != nil {
+							return
+						}
+						time.Sleep(50 * time.Millisecond)
+					}
+				}()
+			}
+			io.Copy(io.Discard, reader)
+
+			closed := waitForEvent(t, logs, "connection_closed")
+			if closed.ClosedBy != "proxy" || closed.Reason != tt.reason {
+				t.Errorf("Expected closed by proxy with reason %s, got %s %q", tt.reason, closed.ClosedBy, closed.Reason)
+			}
+			if elapsed := time.Since(started); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+				t.Errorf("Tunnel closed after %s", elapsed)
+			}
+			if tt.busy && closed.BytesReceived == 0 {
+				t.Errorf("Expected echoed bytes before max_lifetime, got %d", closed.BytesReceived)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rollingQuotaSlots is how many slots a rolling quota window is divided into
+const rollingQuotaSlots = 60
+
+// ByteSize is a number of bytes written in allowlist.yaml as a plain number
+// or with a unit: "500KB", "10MB", "2GiB"
+type ByteSize int64
+
+// byteUnits are the accepted ByteSize suffixes, longest first so "kib" is
+// tried before "b"
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"tib", 1 << 40}, {"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10},
+	{"tb", 1e12}, {"gb", 1e9}, {"mb", 1e6}, {"kb", 1e3},
+	{"b", 1},
+}
+
+// parseByteSize parses a ByteSize such as "1.5GB" or "512KiB"
+func parseByteSize(s string) (ByteSize, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	multiplier := 1.0
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) || n*multiplier > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+// UnmarshalYAML parses a size with parseByteSize
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	size, err := parseByteSize(node.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// String renders the size in the largest binary unit that divides it
+func (b ByteSize) String() string {
+	for _, unit := range byteUnits[:4] {
+		if b >= ByteSize(unit.size) && int64(b)%int64(unit.size) == 0 {
+			return strconv.FormatInt(int64(b)/int64(unit.size), 10) + strings.ToUpper(unit.suffix[:1]) + "iB"
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// BandwidthConfig caps how fast each tunnel of an entry may copy data, in
+// bytes per second. Zero leaves a direction unlimited.
+type BandwidthConfig struct {
+	// Upload is client to destination
+	Upload ByteSize `yaml:"upload"`
+	// Download is destination to client
+	Download ByteSize `yaml:"download"`
+}
+
+// QuotaConfig caps how many bytes an entry's tunnels may copy. Without a
+// window each tunnel has the whole quota to itself; with one, every tunnel
+// of the entry draws on the same quota over a rolling window.
+type QuotaConfig struct {
+	Upload   ByteSize      `yaml:"upload"`
+	Download ByteSize      `yaml:"download"`
+	Window   time.Duration `yaml:"window"`
+}
+
+// trafficPolicy is the bandwidth and quota an allowlist entry sets for its
+// tunnels, one half per direction
+type trafficPolicy struct {
+	upload, download trafficLimit
+}
+
+// trafficLimit applies to one direction of an entry's tunnels
+type trafficLimit struct {
+	rate   int64         // bytes per second, or 0
+	quota  int64         // bytes, or 0
+	window time.Duration // 0 for a per-tunnel quota
+	// rolling is shared by all tunnels of the entry when window is set
+	rolling *rollingQuota
+}
+
+// newTrafficPolicy validates an entry's bandwidth and quota settings and
+// returns nil when it sets neither
+func newTrafficPolicy(bandwidth *BandwidthConfig, quota *QuotaConfig) (*trafficPolicy, error) {
+	if bandwidth == nil && quota == nil {
+		return nil, nil
+	}
+	var policy trafficPolicy
+	if bandwidth != nil {
+		policy.upload.rate = int64(bandwidth.Upload)
+		policy.download.rate = int64(bandwidth.Download)
+	}
+	if quota != nil {
+		if quota.Window < 0 {
+			return nil, fmt.Errorf("quota window %s is negative", quota.Window)
+		}
+		if quota.Upload == 0 && quota.Download == 0 {
+			return nil, fmt.Errorf("quota sets neither upload nor download")
+		}
+		policy.upload.quota, policy.download.quota = int64(quota.Upload), int64(quota.Download)
+		for _, limit := range []*trafficLimit{&policy.upload, &policy.download} {
+			limit.window = quota.Window
+			if limit.quota > 0 && limit.window > 0 {
+				limit.rolling = newRollingQuota(limit.window)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// shaper returns a fresh shaper for one tunnel in direction, or nil when the
+// direction is unlimited. policy may be nil.
+func (policy *trafficPolicy) shaper(direction string) *trafficShaper {
+	if policy == nil {
+		return nil
+	}
+	limit := policy.download
+	if direction == directionClientToDest {
+		limit = policy.upload
+	}
+	if limit.rate == 0 && limit.quota == 0 {
+		return nil
+	}
+	s := &trafficShaper{direction: direction, limit: limit}
+	if limit.rate > 0 {
+		s.tokens = float64(limit.rate)
+		s.last = time.Now()
+	}
+	return s
+}
+
+// quotaError reports a tunnel direction that ran out of quota
+type quotaError struct {
+	Direction string
+	Quota     int64
+	Window    time.Duration
+	Used      int64 // bytes already copied when the quota ran out
+}
+
+func (e *quotaError) Error() string {
+	if e.Window > 0 {
+		return fmt.Sprintf("%s quota of %s per %s exceeded", e.Direction, ByteSize(e.Quota), e.Window)
+	}
+	return fmt.Sprintf("%s quota of %s per tunnel exceeded", e.Direction, ByteSize(e.Quota))
+}
+
+// trafficShaper enforces a trafficLimit on one direction of one tunnel. It is
+// only used by the goroutine copying that direction.
+type trafficShaper struct {
+	direction string
+	limit     trafficLimit
+	used      int64
+
+	// token bucket holding up to one second of bandwidth; it goes into
+	// debt for a read larger than what is left, which admit sleeps off
+	tokens float64
+	last   time.Time
+}
+
+// bufferSize caps reads so that a throttled direction is paced smoothly
+func (s *trafficShaper) bufferSize(size int) int {
+	if s != nil && s.limit.rate > 0 && s.limit.rate < int64(size) {
+		return int(s.limit.rate)
+	}
+	return size
+}
+
+// admit charges n bytes read from the source to the quota and waits until
+// the bandwidth cap allows them to be written. It fails with a quotaError
+// when the bytes would take the direction over its quota.
+func (s *trafficShaper) admit(n int) error {
+	if s == nil {
+		return nil
+	}
+
+	if s.limit.quota > 0 {
+		if s.limit.rolling != nil {
+			if used, ok := s.limit.rolling.reserve(int64(n), s.limit.quota, time.Now()); !ok {
+				return &quotaError{Direction: s.direction, Quota: s.limit.quota, Window: s.limit.window, Used: used}
+			}
+		} else if s.used+int64(n) > s.limit.quota {
+			return &quotaError{Direction: s.direction, Quota: s.limit.quota, Used: s.used}
+		}
+	}
+	s.used += int64(n)
+
+	if s.limit.rate > 0 {
+		now := time.Now()
+		rate := float64(s.limit.rate)
+		s.tokens = math.Min(rate, s.tokens+now.Sub(s.last).Seconds()*rate) - float64(n)
+		s.last = now
+		if s.tokens < 0 {
+			time.Sleep(time.Duration(-s.tokens / rate * float64(time.Second)))
+		}
+	}
+	return nil
+}
+
+// shapedBody charges a forwarded request or response body to a shaper. Once
+// the quota runs out, reads fail with the quotaError after exceeded has been
+// called with it.
+type shapedBody struct {
+	io.ReadCloser
+	shaper   *trafficShaper
+	exceeded func(*quotaError)
+	err      error
+}
+
+// shapeBody wraps body so it is charged to a fresh shaper for direction, or
+// returns it unchanged when the direction is unlimited
+func (policy *trafficPolicy) shapeBody(body io.ReadCloser, direction string, exceeded func(*quotaError)) io.ReadCloser {
+	shaper := policy.shaper(direction)
+	if shaper == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	return &shapedBody{ReadCloser: body, shaper: shaper, exceeded: exceeded}
+}
+
+func (b *shapedBody) Read(buf []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(buf[:b.shaper.bufferSize(len(buf))])
+	if n > 0 {
+		if quotaErr := b.shaper.admit(n); quotaErr != nil {
+			var quota *quotaError
+			errors.As(quotaErr, &quota)
+			b.err = quota
+			b.exceeded(quota)
+			return 0, quota
+		}
+	}
+	return n, err
+}
+
+// rollingQuota counts the bytes copied by every tunnel of an entry over a
+// rolling window, kept as rollingQuotaSlots slots of window/rollingQuotaSlots
+type rollingQuota struct {
+	slot time.Duration
+
+	mu     sync.Mutex
+	counts [rollingQuotaSlots]int64
+	stamps [rollingQuotaSlots]int64 // which slot number each count belongs to
+}
+
+func newRollingQuota(window time.Duration) *rollingQuota {
+	slot := window / rollingQuotaSlots
+	if slot <= 0 {
+		slot = 1
+	}
+	return &rollingQuota{slot: slot}
+}
+
+// reserve adds n bytes at now unless that would take the window's total past
+// quota. It returns the total before n was added.
+func (q *rollingQuota) reserve(n, quota int64, now time.Time) (int64, bool) {
+	current := now.UnixNano() / int64(q.slot)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var used int64
+	for i, stamp := range q.stamps {
+		if stamp > current-rollingQuotaSlots && stamp <= current {
+			used += q.counts[i]
+		}
+	}
+	if used+n > quota {
+		return used, false
+	}
+
+	i := current % rollingQuotaSlots
+	if q.stamps[i] != current {
+		q.stamps[i], q.counts[i] = current, 0
+	}
+	q.counts[i] += n
+	return used, true
+}
+
+// logQuotaExceeded logs a tunnel direction that ran out of quota
+func (p *ProxyServer) logQuotaExceeded(entry LogEntry, rule *hostRule, quota *quotaError) {
+	entry.Level = LogLevelWarning
+	entry.Event = "quota_exceeded"
+	entry.Rule = rule.Entry
+	entry.Reason = quota.Direction
+	entry.Extra = map[string]interface{}{
+		"quota_bytes": quota.Quota,
+		"used_bytes":  quota.Used,
+	}
+	if quota.Window > 0 {
+		entry.Extra["window"] = quota.Window.String()
+	}
+	p.logger.Log(entry)
+}
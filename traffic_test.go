@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ByteSize
+		text  string
+	}{
+		{"1000", 1000, "1000B"},
+		{"500KB", 500000, "500000B"},
+		{"10MB", 10000000, "10000000B"},
+		{"1.5GB", 1500000000, "1500000000B"},
+		{"512KiB", 512 << 10, "512KiB"},
+		{"2 GiB", 2 << 30, "2GiB"},
+		{"1mib", 1 << 20, "1MiB"},
+		{"0", 0, "0B"},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", tt.input, got, err, tt.want)
+			continue
+		}
+		if got.String() != tt.text {
+			t.Errorf("ByteSize(%d).String() = %q, want %q", got, got.String(), tt.text)
+		}
+	}
+
+	for _, input := range []string{"", "MB", "-1KB", "ten", "10XB", "1e30TB"} {
+		if _, err := parseByteSize(input); err == nil {
+			t.Errorf("parseByteSize(%q) should fail", input)
+		}
+	}
+}
+
+func TestLoadTrafficPolicy(t *testing.T) {
+	proxy := newTestProxy(t, `allowlist:
+  - example.com
+  - host: mirror.example.com
+    bandwidth: {download: 10MiB}
+    quota: {download: 2GiB, window: 1h}
+`)
+	if rule, _ := proxy.allowlist.match("example.com", "443"); rule.Traffic != nil {
+		t.Error("An entry without limits should have no traffic policy")
+	}
+	rule, _ := proxy.allowlist.match("mirror.example.com", "443")
+	if rule.Traffic == nil {
+		t.Fatal("Expected a traffic policy")
+	}
+	if rule.Traffic.shaper(directionClientToDest) != nil {
+		t.Error("Upload should be unlimited")
+	}
+	down := rule.Traffic.shaper(directionDestToClient)
+	if down == nil || down.limit.rate != 10<<20 || down.limit.quota != 2<<30 || down.limit.rolling == nil {
+		t.Errorf("Unexpected download limit %+v", down)
+	}
+	if rule.Entry != "mirror.example.com bandwidth [upload 0B, download 10MiB] quota [upload 0B, download 2GiB, window 1h0m0s]" {
+		t.Errorf("Unexpected entry text %q", rule.Entry)
+	}
+
+	original := allowlistYAML
+	defer func() { allowlistYAML = original }()
+	for _, config := range []string{
+		"allowlist:\n  - {host: example.com, bandwidth: {upload: lots}}\n",
+		"allowlist:\n  - {host: example.com, quota: {window: 1h}}\n",
+		"allowlist:\n  - {host: example.com, quota: {upload: 1MB, window: -1h}}\n",
+		"allowlist:\n  - example.com\ndenylist:\n  - {host: bad.example.com, quota: {upload: 1MB}}\n",
+	} {
+		allowlistYAML = []byte(config)
+		if _, err := NewProxyServer("localhost:0", NewLogger(io.Discard)); err == nil {
+			t.Errorf("Expected an error for config:\n%s", config)
+		}
+	}
+}
+
+func TestTrafficShaperQuota(t *testing.T) {
+	policy, err := newTrafficPolicy(nil, &QuotaConfig{Upload: 100})
+	if err != nil {
+		t.Fatalf("newTrafficPolicy: %v", err)
+	}
+
+	// A per-tunnel quota starts afresh for every tunnel
+	for i := 0; i < 2; i++ {
+		shaper := policy.shaper(directionClientToDest)
+		if err := shaper.admit(60); err != nil {
+			t.Fatalf("Tunnel %d: first 60 bytes refused: %v", i, err)
+		}
+		err := shaper.admit(60)
+		quota, ok := err.(*quotaError)
+		if !ok || quota.Used != 60 || quota.Quota != 100 || quota.Window != 0 {
+			t.Errorf("Tunnel %d: expected a quotaError after 60 bytes, got %v", i, err)
+		}
+	}
+}
+
+func TestRollingQuota(t *testing.T) {
+	q := newRollingQuota(time.Minute)
+	start := time.Unix(1700000000, 0)
+
+	if _, ok := q.reserve(60, 100, start); !ok {
+		t.Fatal("First reservation refused")
+	}
+	if used, ok := q.reserve(50, 100, start.Add(30*time.Second)); ok || used != 60 {
+		t.Errorf("Expected the window to be full with 60 bytes used, got %d %v", used, ok)
+	}
+	if _, ok := q.reserve(40, 100, start.Add(30*time.Second)); !ok {
+		t.Error("Reservation within the quota refused")
+	}
+	// The first 60 bytes leave the window after a minute
+	if used, ok := q.reserve(50, 100, start.Add(61*time.Second)); !ok || used != 40 {
+		t.Errorf("Expected 40 bytes in the window after it moved on, got %d %v", used, ok)
+	}
+}
+
+func TestTrafficShaperBandwidth(t *testing.T) {
+	policy, err := newTrafficPolicy(&BandwidthConfig{Download: 64 << 10}, nil)
+	if err != nil {
+		t.Fatalf("newTrafficPolicy: %v", err)
+	}
+	shaper := policy.shaper(directionDestToClient)
+	if size := shaper.bufferSize(128 << 10); size != 64<<10 {
+		t.Errorf("Expected reads capped at one second of bandwidth, got %d", size)
+	}
+
+	// One second of burst is free, the next half second is paced
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		shaper.admit(32 << 10)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected about 500ms of throttling, took %s", elapsed)
+	}
+}
+
+func TestTunnelQuotaExceeded(t *testing.T) {
+	echo := startEchoServer(t)
+	dest := echo.Addr().String()
+	proxy := newTestProxy(t, fmt.Sprintf("allowlist:\n  - {host: %q, quota: {upload: 10}}\n", dest))
+	logs := &syncBuffer{}
+	proxy.logger = NewLogger(logs)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, reader, status := connectThrough(t, proxyServer.Listener.Addr().String(), dest)
+	defer conn.Close()
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(reader, make([]byte, 5)); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+
+	// The next write takes the upload past its quota
+	conn.Write([]byte("0123456789"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatalf("Expected the tunnel to be closed, got %v", err)
+	}
+
+	exceeded := waitForEvent(t, logs, "quota_exceeded")
+	if exceeded.Reason != directionClientToDest || exceeded.Extra["quota_bytes"] != float64(10) || exceeded.Extra["used_bytes"] != float64(5) {
+		t.Errorf("Unexpected quota_exceeded entry %+v", exceeded)
+	}
+	closed := waitForEvent(t, logs, "connection_closed")
+	if closed.ClosedBy != "proxy" || closed.Reason != "quota_exceeded" || closed.BytesSent != 5 {
+		t.Errorf("Unexpected connection_closed entry %+v", closed)
+	}
+	if closed.ConnectionID != exceeded.ConnectionID {
+		t.Error("quota_exceeded and connection_closed should share a connection ID")
+	}
+}
+
+func TestForwardQuotaExceeded(t *testing.T) {
+	destServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("abcdef"))
+	}))
+	defer destServer.Close()
+	destHost := strings.TrimPrefix(destServer.URL, "http://")
+
+	proxy := newTestProxy(t, fmt.Sprintf("allowlist:\n  - {host: %q, quota: {upload: 10, download: 10, window: 1h}}\n", destHost))
+	logs := &syncBuffer{}
+	proxy.logger = NewLogger(logs)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	client := newForwardingClient(t, proxyServer.URL)
+
+	resp, err := client.Get(destServer.URL)
+	if err != nil {
+		t.Fatalf("First request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "abcdef" {
+		t.Fatalf("Expected the first body within the quota, got %q", body)
+	}
+
+	// The second response takes the entry's download window past its quota
+	resp, err = client.Get(destServer.URL)
+	if err == nil {
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatalf("Expected the response over quota to be cut off, got %q", body)
+	}
+	exceeded := waitForEvent(t, logs, "quota_exceeded")
+	if exceeded.Reason != directionDestToClient || exceeded.Protocol != "http" || exceeded.Extra["used_bytes"] != float64(6) {
+		t.Errorf("Unexpected quota_exceeded entry %+v", exceeded)
+	}
+
+	// A request body over the upload quota is refused before a response
+	resp, err = client.Post(destServer.URL, "text/plain", strings.NewReader("0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("Upload request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for an upload over quota, got %d", resp.StatusCode)
+	}
+	exceeded = waitForEntry(t, logs, "quota_exceeded", func(entry LogEntry) bool { return entry.Reason == directionClientToDest })
+	if !strings.HasPrefix(exceeded.Rule, destHost) {
+		t.Errorf("Expected the entry in the quota_exceeded rule, got %+v", exceeded)
+	}
+}